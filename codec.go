@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// StateCodec turns a LimiterState into the bytes stored in the KV backend and
+// back. Every strategy that stores a serialized LimiterState goes through
+// stateCodec, so the encoding is part of the critical section being measured.
+type StateCodec interface {
+	Name() string
+	// ID is written into the state header (see encodeState) and must never be
+	// reused for a different encoding.
+	ID() uint8
+	Marshal(state LimiterState) ([]byte, error)
+	Unmarshal(data []byte, state *LimiterState) error
+}
+
+// stateCodec is the codec used by the SetNX, WATCH and TiKV strategies. It is
+// chosen once per run with the STATE_CODEC environment variable.
+var stateCodec StateCodec = jsonCodec{}
+
+var stateCodecs = map[string]StateCodec{
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+	"proto":   protoCodec{},
+	"binary":  binaryCodec{},
+}
+
+func codecByID(id uint8) (StateCodec, bool) {
+	for _, codec := range stateCodecs {
+		if codec.ID() == id {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// codecFromEnv returns the codec named by STATE_CODEC, defaulting to JSON.
+func codecFromEnv() (StateCodec, error) {
+	name := os.Getenv("STATE_CODEC")
+	if name == "" {
+		return jsonCodec{}, nil
+	}
+	codec, ok := stateCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown STATE_CODEC %q", name)
+	}
+	return codec, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) ID() uint8    { return 1 }
+
+func (jsonCodec) Marshal(state LimiterState) ([]byte, error) {
+	return json.Marshal(state)
+}
+
+func (jsonCodec) Unmarshal(data []byte, state *LimiterState) error {
+	return json.Unmarshal(data, state)
+}
+
+// msgpackCodec reuses the json struct tags so both encodings have the same keys.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) ID() uint8    { return 2 }
+
+func (msgpackCodec) Marshal(state LimiterState) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, state *LimiterState) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(state)
+}
+
+// protoCodec writes the protobuf wire format by hand, so no generated code is
+// needed. The equivalent schema is:
+//
+//	message Window {
+//	  int64 count = 1;
+//	  int64 limit = 2;
+//	  int64 start_unix_nano = 3;
+//	  int64 period_nanos = 4;
+//	}
+//	message LimiterState {
+//	  repeated Window sliding_windows = 1;
+//	  repeated Window fixed_window = 2;
+//	}
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+func (protoCodec) ID() uint8    { return 3 }
+
+func (protoCodec) Marshal(state LimiterState) ([]byte, error) {
+	var b []byte
+	for _, w := range state.SlidingWindows {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendProtoWindow(nil, w.Count, w.Limit, w.StartTime, w.Period))
+	}
+	for _, w := range state.FixedWindow {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendProtoWindow(nil, w.Count, w.Limit, w.StartTime, w.Period))
+	}
+	return b, nil
+}
+
+func appendProtoWindow(b []byte, count, limit int64, start time.Time, period time.Duration) []byte {
+	for i, v := range []int64{count, limit, unixNano(start), int64(period)} {
+		if v == 0 {
+			continue
+		}
+		b = protowire.AppendTag(b, protowire.Number(i+1), protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	}
+	return b
+}
+
+func (protoCodec) Unmarshal(data []byte, state *LimiterState) error {
+	*state = LimiterState{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if (num != 1 && num != 2) || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		msg, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var fields [4]int64
+		for len(msg) > 0 {
+			fnum, ftyp, m := protowire.ConsumeTag(msg)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			msg = msg[m:]
+			if fnum < 1 || fnum > 4 || ftyp != protowire.VarintType {
+				m = protowire.ConsumeFieldValue(fnum, ftyp, msg)
+			} else {
+				var v uint64
+				v, m = protowire.ConsumeVarint(msg)
+				fields[fnum-1] = int64(v)
+			}
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			msg = msg[m:]
+		}
+
+		if num == 1 {
+			state.SlidingWindows = append(state.SlidingWindows, SlidingWindow{
+				Count: fields[0], Limit: fields[1], StartTime: fromUnixNano(fields[2]), Period: time.Duration(fields[3]),
+			})
+		} else {
+			state.FixedWindow = append(state.FixedWindow, FixedWindow{
+				Count: fields[0], Limit: fields[1], StartTime: fromUnixNano(fields[2]), Period: time.Duration(fields[3]),
+			})
+		}
+	}
+	return nil
+}
+
+// binaryCodec is a fixed-width layout: two uint16 window counts (sliding, then
+// fixed) followed by 32 bytes per window (count, limit, start in unix nanos,
+// period in nanos), all big-endian int64s.
+type binaryCodec struct{}
+
+const binaryWindowSize = 32
+
+func (binaryCodec) Name() string { return "binary" }
+func (binaryCodec) ID() uint8    { return 4 }
+
+func (binaryCodec) Marshal(state LimiterState) ([]byte, error) {
+	if len(state.SlidingWindows) > 0xffff || len(state.FixedWindow) > 0xffff {
+		return nil, fmt.Errorf("too many windows for binary codec")
+	}
+	b := make([]byte, 4, 4+binaryWindowSize*(len(state.SlidingWindows)+len(state.FixedWindow)))
+	binary.BigEndian.PutUint16(b[0:], uint16(len(state.SlidingWindows)))
+	binary.BigEndian.PutUint16(b[2:], uint16(len(state.FixedWindow)))
+	for _, w := range state.SlidingWindows {
+		b = appendBinaryWindow(b, w.Count, w.Limit, w.StartTime, w.Period)
+	}
+	for _, w := range state.FixedWindow {
+		b = appendBinaryWindow(b, w.Count, w.Limit, w.StartTime, w.Period)
+	}
+	return b, nil
+}
+
+func appendBinaryWindow(b []byte, count, limit int64, start time.Time, period time.Duration) []byte {
+	b = binary.BigEndian.AppendUint64(b, uint64(count))
+	b = binary.BigEndian.AppendUint64(b, uint64(limit))
+	b = binary.BigEndian.AppendUint64(b, uint64(unixNano(start)))
+	return binary.BigEndian.AppendUint64(b, uint64(period))
+}
+
+func (binaryCodec) Unmarshal(data []byte, state *LimiterState) error {
+	if len(data) < 4 {
+		return fmt.Errorf("binary state too short: %d bytes", len(data))
+	}
+	nSliding := int(binary.BigEndian.Uint16(data[0:]))
+	nFixed := int(binary.BigEndian.Uint16(data[2:]))
+	data = data[4:]
+	if len(data) != binaryWindowSize*(nSliding+nFixed) {
+		return fmt.Errorf("binary state has %d bytes, want %d", len(data), binaryWindowSize*(nSliding+nFixed))
+	}
+
+	field := func(i int) int64 {
+		return int64(binary.BigEndian.Uint64(data[i*8:]))
+	}
+	*state = LimiterState{
+		SlidingWindows: make([]SlidingWindow, nSliding),
+		FixedWindow:    make([]FixedWindow, nFixed),
+	}
+	for i := range state.SlidingWindows {
+		state.SlidingWindows[i] = SlidingWindow{
+			Count: field(0), Limit: field(1), StartTime: fromUnixNano(field(2)), Period: time.Duration(field(3)),
+		}
+		data = data[binaryWindowSize:]
+	}
+	for i := range state.FixedWindow {
+		state.FixedWindow[i] = FixedWindow{
+			Count: field(0), Limit: field(1), StartTime: fromUnixNano(field(2)), Period: time.Duration(field(3)),
+		}
+		data = data[binaryWindowSize:]
+	}
+	return nil
+}
+
+// unixNano maps the zero time to 0 rather than an out-of-range value.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// observeLockHold, when set, is called with how long updateLimiterStateWithLock
+// held its SetNX lock. Only the codec benchmark sets it.
+var observeLockHold func(time.Duration)
+
+// percentile returns the p-th percentile (0-1) of latencies, sorting in place.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	idx := int(float64(len(latencies)) * p)
+	if idx >= len(latencies) {
+		idx = len(latencies) - 1
+	}
+	return latencies[idx]
+}
+
+// benchState is a three-window plan (per minute, per 3 hours, per day), which is
+// closer to what production state looks like than the single-window experiments.
+func benchState(now time.Time) LimiterState {
+	return LimiterState{
+		SlidingWindows: []SlidingWindow{
+			{Limit: 1_000_000, StartTime: now, Period: time.Minute},
+			{Limit: 1_000_000, StartTime: now, Period: 3 * time.Hour},
+		},
+		FixedWindow: []FixedWindow{
+			{Limit: 1_000_000, StartTime: now, Period: 24 * time.Hour},
+		},
+	}
+}
+
+// main10 compares the state codecs: first the raw encode+decode cost, then how
+// that cost shows up in the SetNX lock hold time and request p95.
+func main10() {
+	rdb := newRedisClient()
+	defer rdb.Close()
+
+	ctx := context.Background()
+	userID := "test_user"
+	endpointID := "test_endpoint"
+	key := limiterKey(userID, endpointID)
+	const roundTrips = 10000
+
+	fmt.Printf("%-8s %6s %12s %12s %12s %12s\n", "codec", "bytes", "round-trip", "hold p50", "hold p95", "request p95")
+	for _, name := range []string{"json", "msgpack", "proto", "binary"} {
+		codec := stateCodecs[name]
+		state := benchState(time.Now())
+
+		encoded, err := codec.Marshal(state)
+		if err != nil {
+			log.Fatalf("%s: marshal failed: %v", name, err)
+		}
+		start := time.Now()
+		for i := 0; i < roundTrips; i++ {
+			b, _ := codec.Marshal(state)
+			var decoded LimiterState
+			if err := codec.Unmarshal(b, &decoded); err != nil {
+				log.Fatalf("%s: unmarshal failed: %v", name, err)
+			}
+		}
+		roundTrip := time.Since(start) / roundTrips
+
+		stateCodec = codec
+		seed, err := encodeState(state)
+		if err != nil {
+			log.Fatalf("%s: encode failed: %v", name, err)
+		}
+		rdb.Set(ctx, key, seed, 24*time.Hour)
+
+		var mu sync.Mutex
+		var holds, latencies []time.Duration
+		observeLockHold = func(d time.Duration) {
+			mu.Lock()
+			holds = append(holds, d)
+			mu.Unlock()
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < numRoutines; i++ {
+			wg.Add(1)
+			go func(routineID int) {
+				defer wg.Done()
+				for j := 0; j < updatesPerRoutine; j++ {
+					start := time.Now()
+					if _, err := updateLimiterStateWithLock(ctx, rdb, userID, endpointID, 1); err != nil {
+						log.Printf("%s: error in routine %d: %v", name, routineID, err)
+						continue
+					}
+					elapsed := time.Since(start)
+					mu.Lock()
+					latencies = append(latencies, elapsed)
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		observeLockHold = nil
+
+		fmt.Printf("%-8s %6d %12v %12v %12v %12v\n", name, len(encoded), roundTrip,
+			percentile(holds, 0.50), percentile(holds, 0.95), percentile(latencies, 0.95))
+	}
+	stateCodec = jsonCodec{}
+}
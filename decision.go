@@ -0,0 +1,112 @@
+package main
+
+import "time"
+
+// Decision is the outcome of one limiter check. Limit, Remaining and ResetAfter
+// describe the tightest window, i.e. the one with the fewest units left.
+type Decision struct {
+	Allowed    bool          `json:"allowed"`
+	Limit      int64         `json:"limit"`
+	Remaining  int64         `json:"remaining"`
+	ResetAfter time.Duration `json:"reset_after"`
+	// LeaseID is set when an allowed check holds a slot until it's released
+	LeaseID string `json:"lease_id,omitempty"`
+}
+
+// resetWindow zeroes a window whose period has elapsed. Fixed windows stay
+// aligned to their original start; sliding windows restart from now, which is
+// the closest we can get to a true sliding window with only a count to go on.
+func resetWindow(count *int64, start *time.Time, period time.Duration, now time.Time, aligned bool) {
+	if period <= 0 || now.Before(start.Add(period)) {
+		return
+	}
+	*count = 0
+	if aligned {
+		elapsed := now.Sub(*start)
+		*start = start.Add(elapsed - elapsed%period)
+	} else {
+		*start = now
+	}
+}
+
+// apply resets expired windows, then increments every window by tokens if all
+// of them have room. The state is left untouched (apart from resets) when any
+// window would go over its limit.
+func (s *LimiterState) apply(tokens int64, now time.Time) Decision {
+	for i := range s.SlidingWindows {
+		w := &s.SlidingWindows[i]
+		resetWindow(&w.Count, &w.StartTime, w.Period, now, false)
+	}
+	for i := range s.FixedWindow {
+		w := &s.FixedWindow[i]
+		resetWindow(&w.Count, &w.StartTime, w.Period, now, true)
+	}
+
+	allowed := true
+	for _, w := range s.SlidingWindows {
+		if w.Count+tokens > w.Limit {
+			allowed = false
+		}
+	}
+	for _, w := range s.FixedWindow {
+		if w.Count+tokens > w.Limit {
+			allowed = false
+		}
+	}
+
+	if allowed {
+		for i := range s.SlidingWindows {
+			s.SlidingWindows[i].Count += tokens
+		}
+		for i := range s.FixedWindow {
+			s.FixedWindow[i].Count += tokens
+		}
+	}
+
+	d := Decision{Allowed: allowed, Remaining: -1}
+	tighten := func(count, limit int64, start time.Time, period time.Duration) {
+		remaining := limit - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		if d.Remaining >= 0 && remaining >= d.Remaining {
+			return
+		}
+		d.Limit = limit
+		d.Remaining = remaining
+		d.ResetAfter = 0
+		if period > 0 {
+			d.ResetAfter = start.Add(period).Sub(now)
+		}
+	}
+	for _, w := range s.SlidingWindows {
+		tighten(w.Count, w.Limit, w.StartTime, w.Period)
+	}
+	for _, w := range s.FixedWindow {
+		tighten(w.Count, w.Limit, w.StartTime, w.Period)
+	}
+	if d.Remaining < 0 {
+		d.Remaining = 0
+	}
+	return d
+}
+
+// counterDecision is the Decision for counters that share one limit, given
+// their counts after the check and their keys' TTLs (nil or negative for
+// counters that never expire). The tightest counter is the fullest one.
+func counterDecision(allowed bool, limit int64, counts []int64, ttls []time.Duration) Decision {
+	d := Decision{Allowed: allowed, Limit: limit, Remaining: limit}
+	tightest := -1
+	for i, count := range counts {
+		remaining := max(limit-count, 0)
+		if tightest >= 0 && remaining >= d.Remaining {
+			continue
+		}
+		tightest = i
+		d.Remaining = remaining
+	}
+	if tightest >= 0 && tightest < len(ttls) && ttls[tightest] > 0 {
+		d.ResetAfter = ttls[tightest]
+	}
+	return d
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+	"github.com/openmeterio/openmeter/pkg/models"
+	"golang.org/x/sync/singleflight"
+)
+
+// entitlementCache is a read-through cache of entitlement values. OpenMeter's
+// balance trails ingest by 15 seconds or more anyway, so serving it for a few
+// more seconds costs little and saves a 56-100ms check per request.
+//
+// To keep a busy subject from running far past its limit between fetches,
+// usage logged through recordUsage is taken off the cached balance. Only
+// usage from within ingestLag of the fetch, or after it, is taken off, since
+// anything older is already in OpenMeter's answer. Subjects that go idle are
+// forgotten once neither applies to them any more.
+type entitlementCache struct {
+	fetch     func(ctx context.Context, subject string, feature string) (Entitlement, error)
+	ttl       time.Duration
+	ingestLag time.Duration
+	// meters is which meter each feature counts, for recordUsage
+	meters map[string]MeterSpec
+
+	group singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]cachedEntitlement
+	usage   map[string][]loggedUsage
+	// lastPrune is when entries and usage were last cleared of subjects
+	// that have gone idle
+	lastPrune time.Time
+
+	fetches atomic.Int64
+}
+
+type cachedEntitlement struct {
+	ent       Entitlement
+	fetchedAt time.Time
+}
+
+type loggedUsage struct {
+	at     time.Time
+	amount float64
+}
+
+// newEntitlementCache caches what fetch returns for ttl. Features are matched
+// to meters through spec.
+func newEntitlementCache(fetch func(ctx context.Context, subject string, feature string) (Entitlement, error), ttl time.Duration, spec ProvisioningSpec) *entitlementCache {
+	meterBySlug := make(map[string]MeterSpec, len(spec.Meters))
+	for _, m := range spec.Meters {
+		meterBySlug[m.Slug] = m
+	}
+	meters := make(map[string]MeterSpec, len(spec.Features))
+	for _, f := range spec.Features {
+		if m, ok := meterBySlug[f.MeterSlug]; ok {
+			meters[f.Key] = m
+		}
+	}
+	return &entitlementCache{
+		fetch:     fetch,
+		ttl:       ttl,
+		ingestLag: 15 * time.Second,
+		meters:    meters,
+		entries:   make(map[string]cachedEntitlement),
+		usage:     make(map[string][]loggedUsage),
+	}
+}
+
+// get returns subject's entitlement for feature, fetching it if the cached
+// one is missing or older than ttl. Concurrent misses for the same key share
+// one fetch. Errors aren't cached.
+func (c *entitlementCache) get(ctx context.Context, subject string, feature string) (Entitlement, error) {
+	key := subject + "/" + feature
+	c.mu.Lock()
+	c.pruneLocked(time.Now())
+	entry, ok := c.entries[key]
+	if ok && time.Since(entry.fetchedAt) < c.ttl {
+		ent := c.adjustLocked(key, entry)
+		c.mu.Unlock()
+		return ent, nil
+	}
+	c.mu.Unlock()
+
+	ch := c.group.DoChan(key, func() (any, error) {
+		c.fetches.Add(1)
+		// Shared by every caller waiting on it, so one giving up mustn't
+		// cancel it for the rest
+		fetchedAt := time.Now()
+		ent, err := c.fetch(context.WithoutCancel(ctx), subject, feature)
+		if err != nil {
+			return nil, err
+		}
+		entry := cachedEntitlement{ent: ent, fetchedAt: fetchedAt}
+		c.mu.Lock()
+		c.entries[key] = entry
+		c.mu.Unlock()
+		return entry, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return Entitlement{Feature: feature}, res.Err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.adjustLocked(key, res.Val.(cachedEntitlement)), nil
+	case <-ctx.Done():
+		return Entitlement{Feature: feature}, fmt.Errorf("failed to get entitlement: %w", ctx.Err())
+	}
+}
+
+// adjustLocked takes usage logged since entry was fetched off its balance. A
+// balance used up locally denies access, unless OpenMeter had already
+// allowed it at zero, which means a soft limit.
+func (c *entitlementCache) adjustLocked(key string, entry cachedEntitlement) Entitlement {
+	ent := entry.ent
+	if ent.Kind != EntitlementMetered {
+		return ent
+	}
+	since := entry.fetchedAt.Add(-c.ingestLag)
+	var logged float64
+	for _, u := range c.usage[key] {
+		if u.at.After(since) {
+			logged += u.amount
+		}
+	}
+	if logged == 0 {
+		return ent
+	}
+	ent.Usage += logged
+	if logged < ent.Balance {
+		ent.Balance -= logged
+		return ent
+	}
+	ent.Overage += logged - ent.Balance
+	if ent.Balance > 0 {
+		ent.HasAccess = false
+	}
+	ent.Balance = 0
+	return ent
+}
+
+// pruneLocked drops entries past their ttl, which would be fetched again
+// anyway, and usage too old to apply to any entry, at most once per ttl.
+func (c *entitlementCache) pruneLocked(now time.Time) {
+	if now.Sub(c.lastPrune) < c.ttl {
+		return
+	}
+	c.lastPrune = now
+	for key, entry := range c.entries {
+		if now.Sub(entry.fetchedAt) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+	cutoff := now.Add(-c.ttl - c.ingestLag)
+	for key, usage := range c.usage {
+		if usage[len(usage)-1].at.Before(cutoff) {
+			delete(c.usage, key)
+		}
+	}
+}
+
+// recordUsage notes ev against every feature whose meter counts it: one per
+// event for COUNT meters, the value property for SUM meters. Other
+// aggregations can't be applied to a balance and are left to OpenMeter. The
+// func it returns takes the usage back off, for an event that turns out not
+// to have reached OpenMeter.
+func (c *entitlementCache) recordUsage(ev UsageEvent) (undo func()) {
+	if c == nil {
+		return func() {}
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(now)
+	recorded := make(map[string]loggedUsage)
+	for feature, m := range c.meters {
+		if m.EventType != ev.Type {
+			continue
+		}
+		var amount float64
+		switch m.Aggregation {
+		case models.MeterAggregationCount:
+			amount = 1
+		case models.MeterAggregationSum:
+			amount = ev.Values[strings.TrimPrefix(m.ValueProperty, "$.")]
+		}
+		if amount == 0 {
+			continue
+		}
+		key := ev.Subject + "/" + feature
+		usage := c.usage[key]
+		// Nothing older than this can apply to a cached entry any more
+		cutoff := now.Add(-c.ttl - c.ingestLag)
+		for len(usage) > 0 && usage[0].at.Before(cutoff) {
+			usage = usage[1:]
+		}
+		entry := loggedUsage{at: now, amount: amount}
+		c.usage[key] = append(usage, entry)
+		recorded[key] = entry
+	}
+	return func() { c.unrecordUsage(recorded) }
+}
+
+// unrecordUsage removes what recordUsage noted, where it's still held.
+func (c *entitlementCache) unrecordUsage(recorded map[string]loggedUsage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range recorded {
+		usage := c.usage[key]
+		for i, u := range usage {
+			if u != entry {
+				continue
+			}
+			usage = append(usage[:i:i], usage[i+1:]...)
+			if len(usage) == 0 {
+				delete(c.usage, key)
+			} else {
+				c.usage[key] = usage
+			}
+			break
+		}
+	}
+}
+
+// lookupEntitlement reads an entitlement through the cache, if there is one.
+func (s *ImageGenService) lookupEntitlement(ctx context.Context, subject string, feature string) (Entitlement, error) {
+	if s.cache == nil {
+		return s.entitlement(ctx, subject, feature)
+	}
+	return s.cache.get(ctx, subject, feature)
+}
+
+// main27 checks a GPU-time entitlement through the cache against a stand-in
+// that takes 60ms per check: 100 concurrent checks share one fetch, later
+// ones are served from memory, and GPU time logged meanwhile is taken off
+// the cached balance until it runs out, although the stand-in still reports
+// the balance it started with, as OpenMeter would until ingest caught up.
+func main27() {
+	ctx := context.Background()
+	om := startStandinOpenMeter()
+	defer om.Close()
+	om.setLatency(60 * time.Millisecond)
+	client, err := openmeter.NewAuthClientWithResponses(om.URL(), "test-token")
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+
+	subject, feature := "customer123", "gputimecheck"
+	yes := true
+	balance, usage := 100.0, 500.0
+	om.setEntitlement(subject, feature, openmeter.EntitlementValue{HasAccess: &yes, Balance: &balance, Usage: &usage})
+
+	svc := &ImageGenService{client: client, feature: "gputimecheck", subject: subject}
+	svc.cache = newEntitlementCache(svc.entitlement, 10*time.Second, defaultProvisioningSpec)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := svc.CheckAvailability(); err != nil {
+				log.Printf("Error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("100 concurrent checks: %v, %d fetch\n", time.Since(start).Round(time.Millisecond), svc.cache.fetches.Load())
+
+	start = time.Now()
+	for i := 0; i < 1000; i++ {
+		if _, err := svc.CheckAvailability(); err != nil {
+			log.Printf("Error: %v", err)
+		}
+	}
+	fmt.Printf("1000 cached checks: %v, %d fetch\n\n", time.Since(start).Round(time.Microsecond), svc.cache.fetches.Load())
+
+	for i := 0; i < 4; i++ {
+		_, err := svc.LogUsage(ctx, UsageEvent{
+			Type:   "text2media",
+			Values: map[string]float64{"gpu_time": 30, "outputs": 4},
+		})
+		if err != nil {
+			log.Printf("Error: %v", err)
+		}
+		ent, err := svc.CheckAvailability()
+		fmt.Printf("After %d x 30s of GPU: access=%v balance=%.0f usage=%.0f overage=%.0f err=%v\n",
+			i+1, ent.HasAccess, ent.Balance, ent.Usage, ent.Overage, err)
+	}
+}
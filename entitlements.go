@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+)
+
+// EntitlementKind is what sort of entitlement a feature has. Only metered
+// entitlements have a balance, usage and overage; only static ones a config.
+type EntitlementKind int
+
+const (
+	EntitlementMetered EntitlementKind = iota
+	EntitlementBoolean
+	EntitlementStatic
+)
+
+func (k EntitlementKind) String() string {
+	switch k {
+	case EntitlementMetered:
+		return "metered"
+	case EntitlementBoolean:
+		return "boolean"
+	case EntitlementStatic:
+		return "static"
+	default:
+		return fmt.Sprintf("EntitlementKind(%d)", int(k))
+	}
+}
+
+// Entitlement is a subject's entitlement value for one feature.
+type Entitlement struct {
+	Feature   string
+	Kind      EntitlementKind
+	HasAccess bool
+	// Balance, Usage and Overage are set for metered entitlements
+	Balance float64
+	Usage   float64
+	Overage float64
+	// Config is set for static entitlements
+	Config string
+}
+
+var (
+	ErrEntitlementNotFound = errors.New("entitlement not found")
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrRateLimited         = errors.New("rate limited")
+)
+
+// EntitlementError is a non-2xx answer to an entitlement read. It wraps
+// ErrEntitlementNotFound, ErrUnauthorized or ErrRateLimited when the status
+// is one of theirs, so callers can use errors.Is.
+type EntitlementError struct {
+	Subject    string
+	Feature    string
+	StatusCode int
+	// RetryAfter is the server's Retry-After, if it sent one
+	RetryAfter time.Duration
+	// Detail is the problem response's detail, if there was one
+	Detail string
+	err    error
+}
+
+func (e *EntitlementError) Error() string {
+	msg := fmt.Sprintf("entitlement %s/%s: status code %d", e.Subject, e.Feature, e.StatusCode)
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (e *EntitlementError) Unwrap() error { return e.err }
+
+func newEntitlementError(subject string, feature string, resp *http.Response, body []byte) *EntitlementError {
+	e := &EntitlementError{Subject: subject, Feature: feature, StatusCode: resp.StatusCode}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		e.err = ErrEntitlementNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		e.err = ErrUnauthorized
+	case http.StatusTooManyRequests:
+		e.err = ErrRateLimited
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	var problem struct {
+		Detail string `json:"detail"`
+	}
+	if json.Unmarshal(body, &problem) == nil {
+		e.Detail = problem.Detail
+	}
+	return e
+}
+
+// entitlement reads subject's entitlement value for feature. OpenMeter leaves
+// out whatever doesn't apply to the entitlement's kind, so every field is
+// checked before it is used; a kind is inferred from which ones are there.
+func (s *ImageGenService) entitlement(ctx context.Context, subject string, feature string) (Entitlement, error) {
+	ent := Entitlement{Feature: feature}
+	resp, err := s.client.GetEntitlementValueWithResponse(ctx, subject, feature, &openmeter.GetEntitlementValueParams{})
+	if err != nil {
+		return ent, fmt.Errorf("failed to get entitlement: %w", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return ent, newEntitlementError(subject, feature, resp.HTTPResponse, resp.Body)
+	}
+	v := resp.JSON200
+	if v == nil || v.HasAccess == nil {
+		return ent, fmt.Errorf("failed to get entitlement %s/%s: response has no hasAccess", subject, feature)
+	}
+	ent.HasAccess = *v.HasAccess
+	switch {
+	case v.Config != nil:
+		ent.Kind = EntitlementStatic
+		ent.Config = *v.Config
+	case v.Balance != nil || v.Usage != nil || v.Overage != nil:
+		ent.Kind = EntitlementMetered
+		if v.Balance != nil {
+			ent.Balance = *v.Balance
+		}
+		if v.Usage != nil {
+			ent.Usage = *v.Usage
+		}
+		if v.Overage != nil {
+			ent.Overage = *v.Overage
+		}
+	default:
+		ent.Kind = EntitlementBoolean
+	}
+	return ent, nil
+}
+
+// usagePeriodEnd reads when subject's current usage period for feature ends,
+// which the entitlement value doesn't say. It changes once per period, so it
+// is kept until it passes.
+func (s *ImageGenService) usagePeriodEnd(ctx context.Context, subject string, feature string) (time.Time, error) {
+	key := subject + "/" + feature
+	if end, ok := s.periodEnds.Load(key); ok && time.Now().Before(end.(time.Time)) {
+		return end.(time.Time), nil
+	}
+	ents, err := listAll[struct {
+		CurrentUsagePeriod *openmeter.Period `json:"currentUsagePeriod"`
+	}]("entitlements of "+subject, func(page int) (int, []byte, error) {
+		resp, err := s.client.ListEntitlementsWithResponse(ctx, &openmeter.ListEntitlementsParams{
+			Subject: &[]string{subject},
+			Feature: &[]string{feature},
+			Page:    &page,
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.StatusCode(), resp.Body, nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, e := range ents {
+		if e.CurrentUsagePeriod != nil {
+			s.periodEnds.Store(key, e.CurrentUsagePeriod.To)
+			return e.CurrentUsagePeriod.To, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// FeatureAccess is one feature's part in an AccessDecision.
+type FeatureAccess struct {
+	Entitlement
+	// Err is why the entitlement couldn't be read, if it couldn't
+	Err error
+}
+
+// AccessDecision is the outcome of checking several features at once. The
+// subject is allowed only if every feature allows it; a feature that failed
+// to answer counts as allowed when failing open and denied when failing
+// closed.
+type AccessDecision struct {
+	Allowed  bool
+	Features []FeatureAccess
+}
+
+// Denied returns the features that denied access, including those that
+// failed to answer unless the check failed open.
+func (d AccessDecision) Denied() []string {
+	var denied []string
+	for _, f := range d.Features {
+		if !f.HasAccess {
+			denied = append(denied, f.Feature)
+		}
+	}
+	return denied
+}
+
+// Failed returns the features whose entitlement couldn't be read.
+func (d AccessDecision) Failed() []string {
+	var failed []string
+	for _, f := range d.Features {
+		if f.Err != nil {
+			failed = append(failed, f.Feature)
+		}
+	}
+	return failed
+}
+
+// CheckAll checks subject's entitlements for every feature concurrently, so
+// three counters cost one round-trip of latency rather than three. The check
+// gives up after checkTimeout, or at ctx's deadline if that comes first; any
+// feature that hasn't answered by then has failed, and failOpen decides what
+// failures mean. The error is only for a call that couldn't be made at all.
+func (s *ImageGenService) CheckAll(ctx context.Context, subject string, features ...string) (AccessDecision, error) {
+	if len(features) == 0 {
+		return AccessDecision{}, fmt.Errorf("no features to check")
+	}
+	if subject == "" {
+		subject = s.subject
+	}
+	if s.checkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.checkTimeout)
+		defer cancel()
+	}
+
+	decision := AccessDecision{Allowed: true, Features: make([]FeatureAccess, len(features))}
+	var wg sync.WaitGroup
+	for i, feature := range features {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ent, err := s.lookupEntitlement(ctx, subject, feature)
+			if err != nil {
+				ent.HasAccess = s.failOpen
+			}
+			decision.Features[i] = FeatureAccess{Entitlement: ent, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	for _, f := range decision.Features {
+		if !f.HasAccess {
+			decision.Allowed = false
+		}
+	}
+	return decision, nil
+}
+
+// main23 checks three features for one subject against the stand-in, first
+// one by one and then with CheckAll, and then lets the entitlement endpoint
+// stall past the check's deadline to show failing closed and failing open.
+func main23() {
+	ctx := context.Background()
+	om := startStandinOpenMeter()
+	defer om.Close()
+	om.setLatency(30 * time.Millisecond)
+
+	client, err := openmeter.NewAuthClientWithResponses(om.URL(), "test-token")
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+	svc := &ImageGenService{
+		client:       client,
+		feature:      "gputimecheck",
+		subject:      "customer123",
+		checkTimeout: 100 * time.Millisecond,
+	}
+
+	subject := "customer123"
+	features := []string{"requests-per-minute", "requests-per-3h", "gpu-time-per-day"}
+	balance, usage := 10.0, 50.0
+	yes, no := true, false
+	om.setEntitlement(subject, features[0], openmeter.EntitlementValue{HasAccess: &yes, Balance: &balance, Usage: &usage})
+	om.setEntitlement(subject, features[1], openmeter.EntitlementValue{HasAccess: &yes, Balance: &balance, Usage: &usage})
+	om.setEntitlement(subject, features[2], openmeter.EntitlementValue{HasAccess: &no, Usage: &usage})
+
+	start := time.Now()
+	for _, feature := range features {
+		if _, err := svc.entitlement(ctx, subject, feature); err != nil {
+			log.Printf("Error: %v", err)
+		}
+	}
+	fmt.Printf("One by one: %v\n", time.Since(start).Round(time.Millisecond))
+
+	start = time.Now()
+	decision, err := svc.CheckAll(ctx, subject, features...)
+	if err != nil {
+		log.Fatalf("check failed: %v", err)
+	}
+	fmt.Printf("CheckAll:   %v\n\n", time.Since(start).Round(time.Millisecond))
+	printDecision(decision)
+
+	om.setLatency(500 * time.Millisecond)
+	for _, failOpen := range []bool{false, true} {
+		svc.failOpen = failOpen
+		start = time.Now()
+		decision, err := svc.CheckAll(ctx, subject, features[:2]...)
+		if err != nil {
+			log.Fatalf("check failed: %v", err)
+		}
+		fmt.Printf("\nStalled, failOpen=%v, gave up after %v\n", failOpen, time.Since(start).Round(time.Millisecond))
+		printDecision(decision)
+	}
+}
+
+func printDecision(d AccessDecision) {
+	fmt.Printf("Allowed: %v, denied by: [%s], failed: [%s]\n",
+		d.Allowed, strings.Join(d.Denied(), " "), strings.Join(d.Failed(), " "))
+	for _, f := range d.Features {
+		status := "ok"
+		if f.Err != nil {
+			status = "error"
+			if errors.Is(f.Err, context.DeadlineExceeded) {
+				status = "timed out"
+			}
+		}
+		fmt.Printf("  %-20s access=%-5v balance=%-4.0f usage=%-4.0f overage=%-4.0f %s\n",
+			f.Feature, f.HasAccess, f.Balance, f.Usage, f.Overage, status)
+	}
+}
+
+// main24 reads one entitlement of each kind from the stand-in, then the
+// answers that used to panic CheckAvailability: a value without hasAccess,
+// an unknown feature, a bad token, rate limiting and a server error.
+func main24() {
+	ctx := context.Background()
+	om := startStandinOpenMeter()
+	defer om.Close()
+	client, err := openmeter.NewAuthClientWithResponses(om.URL(), "test-token")
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+	svc := &ImageGenService{client: client, feature: "gputimecheck", subject: "customer123"}
+
+	subject := "customer123"
+	yes := true
+	balance, usage := 70.0, 30.0
+	config := `{"maxResolution":"1024x1024"}`
+	om.setEntitlement(subject, "gputimecheck", openmeter.EntitlementValue{HasAccess: &yes, Balance: &balance, Usage: &usage})
+	om.setEntitlement(subject, "priority-queue", openmeter.EntitlementValue{HasAccess: &yes})
+	om.setEntitlement(subject, "model-config", openmeter.EntitlementValue{HasAccess: &yes, Config: &config})
+	om.setEntitlement(subject, "malformed", openmeter.EntitlementValue{Balance: &balance})
+	om.failEntitlement(subject, "bad-token", http.StatusUnauthorized)
+	om.failEntitlement(subject, "busy", http.StatusTooManyRequests)
+	om.failEntitlement(subject, "broken", http.StatusInternalServerError)
+
+	for _, feature := range []string{"gputimecheck", "priority-queue", "model-config", "malformed", "unknown", "bad-token", "busy", "broken"} {
+		ent, err := svc.entitlement(ctx, subject, feature)
+		if err != nil {
+			var entErr *EntitlementError
+			kind := "other"
+			switch {
+			case errors.Is(err, ErrEntitlementNotFound):
+				kind = "not found"
+			case errors.Is(err, ErrUnauthorized):
+				kind = "unauthorized"
+			case errors.Is(err, ErrRateLimited):
+				kind = "rate limited"
+			}
+			if errors.As(err, &entErr) && entErr.RetryAfter > 0 {
+				kind += fmt.Sprintf(", retry after %v", entErr.RetryAfter)
+			}
+			fmt.Printf("%-15s error (%s): %v\n", feature, kind, err)
+			continue
+		}
+		fmt.Printf("%-15s %-8v access=%v balance=%.0f usage=%.0f overage=%.0f config=%q\n",
+			feature, ent.Kind, ent.HasAccess, ent.Balance, ent.Usage, ent.Overage, ent.Config)
+	}
+}
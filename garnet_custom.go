@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// garnetCheckIncrCommand is the name a Garnet custom transaction procedure
+// (registered server-side from a C# module) is expected to be registered
+// under. It follows the windowsScript contract, with numkeys in front so keys
+// are where cluster routing looks for them:
+//
+//	LIMITER.CHECKINCR numkeys key... increment limit_1 ttl_ms_1 ... limit_n ttl_ms_n
+//
+// and replies {allowed, {{count, limit, remaining, pttl}, ...}}. This gets the
+// atomicity of the Lua strategy without needing Lua enabled on Garnet.
+const garnetCheckIncrCommand = "LIMITER.CHECKINCR"
+
+// errCustomCommandNotRegistered means the server doesn't know
+// garnetCheckIncrCommand; callers should fall back to another strategy.
+var errCustomCommandNotRegistered = errors.New(garnetCheckIncrCommand + " is not registered on the server")
+
+// garnetCommandRegistered asks the server whether garnetCheckIncrCommand
+// exists, so a caller can pick a strategy once at startup instead of failing
+// on the first request. COMMAND INFO answers nil for unknown commands, and
+// for custom commands registered without command info, so a false here can
+// still be double-checked by calling updateLimiterState11.
+func garnetCommandRegistered(ctx context.Context, rdb redis.UniversalClient) (bool, error) {
+	res, err := rdb.Do(ctx, "COMMAND", "INFO", garnetCheckIncrCommand).Slice()
+	if err != nil {
+		return false, fmt.Errorf("COMMAND INFO failed: %w", err)
+	}
+	return len(res) == 1 && res[0] != nil, nil
+}
+
+// updateLimiterState11 runs the plan through garnetCheckIncrCommand in one
+// round-trip. If the command isn't registered it returns an error wrapping
+// errCustomCommandNotRegistered.
+func updateLimiterState11(ctx context.Context, rdb redis.UniversalClient, userID string, endpointID string, plan []WindowLimit, tokens int64) (Decision, []WindowResult, error) {
+	args := []interface{}{garnetCheckIncrCommand, len(plan)}
+	for _, w := range plan {
+		args = append(args, windowKey(w.Name, userID, endpointID))
+	}
+	args = append(args, tokens)
+	for _, w := range plan {
+		args = append(args, w.Limit, w.Period.Milliseconds())
+	}
+
+	cmd := redis.NewCmd(ctx, args...)
+	cmd.SetFirstKeyPos(2)
+	if err := rdb.Process(ctx, cmd); err != nil {
+		if isUnknownCommandErr(err) {
+			return Decision{}, nil, fmt.Errorf("%w: %v", errCustomCommandNotRegistered, err)
+		}
+		return Decision{}, nil, fmt.Errorf("%s failed: %w", garnetCheckIncrCommand, err)
+	}
+	return parseWindowsReply(plan, cmd.Val())
+}
+
+// main16 checks for the custom command on a stand-in without it, where the
+// strategy is skipped, and on one that has it registered, where it enforces a
+// per-minute/per-day plan from 10 goroutines.
+func main16() {
+	ctx := context.Background()
+	userID := "test_user"
+	endpointID := "test_endpoint"
+	plan := []WindowLimit{
+		{Name: "minute", Limit: 100, Period: time.Minute},
+		{Name: "day", Limit: 500, Period: 24 * time.Hour},
+	}
+
+	for _, register := range []bool{false, true} {
+		server, err := startStandinRedis()
+		if err != nil {
+			log.Fatalf("failed to start stand-in: %v", err)
+		}
+		if register {
+			server.registerCommand(garnetCheckIncrCommand, limiterEvalScript(limiterFunctionBody("check_incr")))
+		}
+		rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+
+		registered, err := garnetCommandRegistered(ctx, rdb)
+		if err != nil {
+			log.Fatalf("failed to detect %s: %v", garnetCheckIncrCommand, err)
+		}
+		fmt.Printf("\n%s registered: %v\n", garnetCheckIncrCommand, registered)
+
+		// Calling it anyway shows what a caller that skipped detection gets
+		if !registered {
+			_, _, err := updateLimiterState11(ctx, rdb, userID, endpointID, plan, 1)
+			fmt.Printf("Call without the command: %v (not registered: %v)\n", err, errors.Is(err, errCustomCommandNotRegistered))
+			rdb.Close()
+			server.Close()
+			continue
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var allowed, denied int
+		startTime := time.Now()
+		for i := 0; i < numRoutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < updatesPerRoutine; j++ {
+					decision, _, err := updateLimiterState11(ctx, rdb, userID, endpointID, plan, 1)
+					if err != nil {
+						log.Printf("Error: %v", err)
+						continue
+					}
+					mu.Lock()
+					if decision.Allowed {
+						allowed++
+					} else {
+						denied++
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		fmt.Printf("Allowed: %d, Denied: %d in %v\n", allowed, denied, time.Since(startTime))
+
+		rdb.Close()
+		server.Close()
+	}
+}
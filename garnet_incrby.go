@@ -17,70 +17,75 @@ const (
 	// updatesPerRoutine = 100
 )
 
-func updateLimiterState2(ctx context.Context, rdb *redis.Client, userID string, endpointID string, tokens int64) error {
+// updateLimiterState2 checks three counters against limit2 with one GET
+// pipeline and charges them with one INCRBY pipeline. Another client can
+// race it between the two, so it can over-admit under contention.
+func updateLimiterState2(ctx context.Context, rdb redis.UniversalClient, userID string, endpointID string, tokens int64) (Decision, error) {
 	// Define our three window keys
-	window1Key := fmt.Sprintf("ratelimit:window1:%s:%s", userID, endpointID)
-	window2Key := fmt.Sprintf("ratelimit:window2:%s:%s", userID, endpointID)
-	window3Key := fmt.Sprintf("ratelimit:window3:%s:%s", userID, endpointID)
+	keys := []string{
+		windowKey("window1", userID, endpointID),
+		windowKey("window2", userID, endpointID),
+		windowKey("window3", userID, endpointID),
+	}
 
-	// Get current values for all windows
+	// Get current values and TTLs for all windows
 	pipe := rdb.Pipeline()
-	window1Get := pipe.Get(ctx, window1Key)
-	window2Get := pipe.Get(ctx, window2Key)
-	window3Get := pipe.Get(ctx, window3Key)
+	gets := make([]*redis.StringCmd, len(keys))
+	pttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		gets[i] = pipe.Get(ctx, key)
+		pttls[i] = pipe.PTTL(ctx, key)
+	}
 	
 	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return Decision{}, fmt.Errorf("failed to read windows: %w", err)
+	}
 	
-	// Handle initial case where keys don't exist
-	window1Count := int64(0)
-	window2Count := int64(0)
-	window3Count := int64(0)
-
-	if err != redis.Nil {
-		if w1, err := window1Get.Int64(); err == nil {
-			window1Count = w1
-		}
-		if w2, err := window2Get.Int64(); err == nil {
-			window2Count = w2
-		}
-		if w3, err := window3Get.Int64(); err == nil {
-			window3Count = w3
+	// Handle initial case where keys don't exist: each missing key counts 0
+	counts := make([]int64, len(keys))
+	ttls := make([]time.Duration, len(keys))
+	for i := range keys {
+		if n, err := gets[i].Int64(); err == nil {
+			counts[i] = n
 		}
+		ttls[i] = pttls[i].Val()
 	}
 
 	// Check if adding tokens would exceed limit in any window
-	if window1Count+tokens > limit2 || 
-	   window2Count+tokens > limit2 || 
-	   window3Count+tokens > limit2 {
-		return fmt.Errorf("rate limit exceeded: window1=%d, window2=%d, window3=%d, limit=%d",
-			window1Count, window2Count, window3Count, limit2)
+	for _, count := range counts {
+		if count+tokens > limit2 {
+			return counterDecision(false, limit2, counts, ttls), nil
+		}
 	}
 
 	// If we're here, we can increment all counters
 	pipe = rdb.Pipeline()
-	pipe.IncrBy(ctx, window1Key, tokens)
-	pipe.IncrBy(ctx, window2Key, tokens)
-	pipe.IncrBy(ctx, window3Key, tokens)
+	incrs := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		incrs[i] = pipe.IncrBy(ctx, key, tokens)
+	}
 	
 	// Set expiry on keys if they're new
-	pipe.Expire(ctx, window1Key, 24*time.Hour)
-	pipe.Expire(ctx, window2Key, 24*time.Hour)
-	pipe.Expire(ctx, window3Key, 24*time.Hour)
+	for _, key := range keys {
+		pipe.Expire(ctx, key, 24*time.Hour)
+	}
 
 	_, err = pipe.Exec(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to increment windows: %w", err)
+		return Decision{}, fmt.Errorf("failed to increment windows: %w", err)
 	}
 
-	return nil
+	for i, incr := range incrs {
+		counts[i] = incr.Val()
+		ttls[i] = 24 * time.Hour
+	}
+	return counterDecision(true, limit2, counts, ttls), nil
 }
 
 func main7() {
 	// Create Redis client
-	rdb := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-		DB:   0,
-	})
+	rdb := newRedisClient()
 	defer rdb.Close()
 
 	// Test parameters
@@ -89,9 +94,9 @@ func main7() {
 	
 	// Initialize keys to 0
 	ctx := context.Background()
-	window1Key := fmt.Sprintf("ratelimit:window1:%s:%s", userID, endpointID)
-	window2Key := fmt.Sprintf("ratelimit:window2:%s:%s", userID, endpointID)
-	window3Key := fmt.Sprintf("ratelimit:window3:%s:%s", userID, endpointID)
+	window1Key := windowKey("window1", userID, endpointID)
+	window2Key := windowKey("window2", userID, endpointID)
+	window3Key := windowKey("window3", userID, endpointID)
 	
 	rdb.Set(ctx, window1Key, 0, 24*time.Hour)
 	rdb.Set(ctx, window2Key, 0, 24*time.Hour)
@@ -132,11 +137,15 @@ func main7() {
 			for j := 0; j < updatesPerRoutine; j++ {
 				start := time.Now()
 				
-				err := updateLimiterState2(ctx, rdb, userID, endpointID, 1)
+				d, err := updateLimiterState2(ctx, rdb, userID, endpointID, 1)
 				if err != nil {
 					log.Printf("Error in routine %d: %v", routineID, err)
 					continue
 				}
+				if !d.Allowed {
+					log.Printf("Rate limited in routine %d: %d/%d left, resets in %v", routineID, d.Remaining, d.Limit, d.ResetAfter)
+					continue
+				}
 				
 				latencyChan <- time.Since(start)
 			}
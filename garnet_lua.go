@@ -23,6 +23,7 @@ const (
 // ARGV[1] = increment amount
 // ARGV[2] = limit3
 // ARGV[3] = TTL in seconds
+// Returns both counts, 1 or 0 for success or failure, and both keys' PTTLs
 var checkAndIncrementScript = redis.NewScript(`
 	local sliding_val = redis.call('GET', KEYS[1])
 	local fixed_val = redis.call('GET', KEYS[2])
@@ -36,7 +37,7 @@ var checkAndIncrementScript = redis.NewScript(`
 	
 	-- Check if incrementing would exceed limit3
 	if sliding_val + increment > limit3 or fixed_val + increment > limit3 then
-		return {sliding_val, fixed_val, 0} -- 0 indicates failure
+		return {sliding_val, fixed_val, 0, redis.call('PTTL', KEYS[1]), redis.call('PTTL', KEYS[2])} -- 0 indicates failure
 	end
 	
 	-- Increment both counters
@@ -47,12 +48,12 @@ var checkAndIncrementScript = redis.NewScript(`
 	redis.call('EXPIRE', KEYS[1], ARGV[3])
 	redis.call('EXPIRE', KEYS[2], ARGV[3])
 	
-	return {sliding_val, fixed_val, 1} -- 1 indicates success
+	return {sliding_val, fixed_val, 1, redis.call('PTTL', KEYS[1]), redis.call('PTTL', KEYS[2])} -- 1 indicates success
 `)
 
-func updateLimiterState7(ctx context.Context, rdb *redis.Client, userID string, endpointID string, tokens int64) error {
-	slidingKey := fmt.Sprintf("ratelimit:sliding:%s:%s", userID, endpointID)
-	fixedKey := fmt.Sprintf("ratelimit:fixed:%s:%s", userID, endpointID)
+func updateLimiterState7(ctx context.Context, rdb redis.UniversalClient, userID string, endpointID string, tokens int64) (Decision, error) {
+	slidingKey := windowKey("sliding", userID, endpointID)
+	fixedKey := windowKey("fixed", userID, endpointID)
 	
 	// Run the Lua script
 	result, err := checkAndIncrementScript.Run(ctx, rdb,
@@ -61,33 +62,29 @@ func updateLimiterState7(ctx context.Context, rdb *redis.Client, userID string,
 		Result()
 	
 	if err != nil {
-		return fmt.Errorf("failed to run script: %w", err)
+		return Decision{}, fmt.Errorf("failed to run script: %w", err)
 	}
 	
 	// Parse the result
 	values, ok := result.([]interface{})
-	if !ok || len(values) != 3 {
-		return fmt.Errorf("unexpected script result format")
+	if !ok || len(values) != 5 {
+		return Decision{}, fmt.Errorf("unexpected script result format")
 	}
 	
-	// Check if operation was successful (last value is 1 for success, 0 for failure)
-	success, ok := values[2].(int64)
-	if !ok || success != 1 {
-		slidingVal, _ := values[0].(int64)
-		fixedVal, _ := values[1].(int64)
-		return fmt.Errorf("rate limit3 exceeded: sliding=%d, fixed=%d, limit3=%d",
-			slidingVal, fixedVal, limit3)
-	}
-	
-	return nil
+	// Check if operation was successful (third value is 1 for success, 0 for failure)
+	slidingVal, _ := values[0].(int64)
+	fixedVal, _ := values[1].(int64)
+	success, _ := values[2].(int64)
+	slidingTTL, _ := values[3].(int64)
+	fixedTTL, _ := values[4].(int64)
+	return counterDecision(success == 1, limit3,
+		[]int64{slidingVal, fixedVal},
+		[]time.Duration{time.Duration(slidingTTL) * time.Millisecond, time.Duration(fixedTTL) * time.Millisecond}), nil
 }
 
 func main8() {
 	// Create Redis client
-	rdb := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-		DB:   0,
-	})
+	rdb := newRedisClient()
 	defer rdb.Close()
 
 	// Test parameters
@@ -96,8 +93,8 @@ func main8() {
 	
 	// Initialize keys to 0
 	ctx := context.Background()
-	slidingKey := fmt.Sprintf("ratelimit:sliding:%s:%s", userID, endpointID)
-	fixedKey := fmt.Sprintf("ratelimit:fixed:%s:%s", userID, endpointID)
+	slidingKey := windowKey("sliding", userID, endpointID)
+	fixedKey := windowKey("fixed", userID, endpointID)
 	
 	rdb.Set(ctx, slidingKey, 0, 24*time.Hour)
 	rdb.Set(ctx, fixedKey, 0, 24*time.Hour)
@@ -136,11 +133,15 @@ func main8() {
 			for j := 0; j < updatesPerRoutine; j++ {
 				start := time.Now()
 				
-				err := updateLimiterState7(ctx, rdb, userID, endpointID, 1)
+				d, err := updateLimiterState7(ctx, rdb, userID, endpointID, 1)
 				if err != nil {
 					log.Printf("Error in routine %d: %v", routineID, err)
 					continue
 				}
+				if !d.Allowed {
+					log.Printf("Rate limited in routine %d: %d/%d left, resets in %v", routineID, d.Remaining, d.Limit, d.ResetAfter)
+					continue
+				}
 				
 				latencyChan <- time.Since(start)
 			}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
@@ -10,13 +9,25 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 )
 
-func updateLimiterStateWithLock(ctx context.Context, rdb *redis.Client, userID string, endpointID string, tokens int64) error {
-	key := fmt.Sprintf("ratelimit:%s:%s", userID, endpointID)
-	lockKey := fmt.Sprintf("lock:%s", key)
-	lockValue := fmt.Sprintf("%d", time.Now().UnixNano())
+// updateLimiterStateWithLock serializes updates to a user's LimiterState with a
+// SetNX lock.
+//
+// Behavior across a primary switch (Sentinel failover): replication is
+// asynchronous, so a lock taken on the old primary may be missing on the new
+// one and a second client can take it while the first still thinks it holds
+// it. Both then read-modify-write the state and one update is lost, which
+// under-counts and can admit a few requests too many; the overshoot is bounded
+// by the locks held at the moment of the switch. Release is compare-and-delete,
+// so a holder that lost its lock never deletes the new owner's. Lock attempts
+// that hit a demoted primary (READONLY) are retried like a busy lock.
+func updateLimiterStateWithLock(ctx context.Context, rdb redis.UniversalClient, userID string, endpointID string, tokens int64) (Decision, error) {
+	key := limiterKey(userID, endpointID)
+	lockKey := limiterLockKey(userID, endpointID)
+	lockValue := uuid.NewString()
 	
 	// Retry configuration
 	maxRetries := 5
@@ -25,6 +36,7 @@ func updateLimiterStateWithLock(ctx context.Context, rdb *redis.Client, userID s
 
 	// Try to acquire lock with retries
 	var err error
+	acquired := false
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		// Try to acquire lock and get previous value in single atomic operation
 		result := rdb.SetArgs(ctx, lockKey, lockValue, redis.SetArgs{
@@ -33,13 +45,15 @@ func updateLimiterStateWithLock(ctx context.Context, rdb *redis.Client, userID s
 			TTL:  5 * time.Second,
 		})
 		
+		// With GET, a nil reply means there was no previous value, so our SET
+		// went through and we hold the lock. A value means someone else does.
 		_, err := result.Result()
-		if err == nil {
-			// Lock acquired successfully (no previous value)
+		if err == redis.Nil {
+			acquired = true
 			break
 		}
-		if err != redis.Nil {
-			return fmt.Errorf("failed to acquire lock: %w", err)
+		if err != nil && !isFailoverErr(err) {
+			return Decision{}, fmt.Errorf("failed to acquire lock: %w", err)
 		}
 		
 		// Calculate backoff delay with jitter
@@ -51,7 +65,7 @@ func updateLimiterStateWithLock(ctx context.Context, rdb *redis.Client, userID s
 		
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("context cancelled while waiting for lock")
+			return Decision{}, fmt.Errorf("context cancelled while waiting for lock")
 		case <-time.After(jitter):
 			// Before retrying, check if the lock has expired
 			// This helps prevent deadlocks if a client crashes while holding the lock
@@ -63,11 +77,17 @@ func updateLimiterStateWithLock(ctx context.Context, rdb *redis.Client, userID s
 			}
 		}
 	}
+	if !acquired {
+		return Decision{}, fmt.Errorf("failed to acquire lock after %d attempts", maxRetries)
+	}
 
 	// Ensure we release the lock, but only if we still own it
+	lockedAt := time.Now()
 	defer func() {
-		// Only delete if the value matches what we set
-		rdb.Del(ctx, lockKey)
+		releaseLock(ctx, rdb, lockKey, lockValue)
+		if observeLockHold != nil {
+			observeLockHold(time.Since(lockedAt))
+		}
 	}()
 
 	// Get the current state
@@ -88,60 +108,69 @@ func updateLimiterStateWithLock(ctx context.Context, rdb *redis.Client, userID s
 			}},
 		}
 	} else if err != nil {
-		return fmt.Errorf("redis get error: %w", err)
+		return Decision{}, fmt.Errorf("redis get error: %w", err)
 	} else {
 		// Deserialize existing state
-		if err := json.Unmarshal(val, &state); err != nil {
-			return fmt.Errorf("unmarshal error: %w", err)
-		}
-	}
-
-	// Check limits
-	for i := range state.SlidingWindows {
-		if state.SlidingWindows[i].Count+tokens > state.SlidingWindows[i].Limit {
-			return fmt.Errorf("sliding window limit exceeded")
-		}
-	}
-	for i := range state.FixedWindow {
-		if state.FixedWindow[i].Count+tokens > state.FixedWindow[i].Limit {
-			return fmt.Errorf("fixed window limit exceeded")
+		if err := decodeState(val, &state); err != nil {
+			return Decision{}, fmt.Errorf("unmarshal error: %w", err)
 		}
 	}
 
-	// Update counters
-	for i := range state.SlidingWindows {
-		state.SlidingWindows[i].Count += tokens
-	}
-	for i := range state.FixedWindow {
-		state.FixedWindow[i].Count += tokens
+	// Check limits and update counters; a denied request writes nothing
+	decision := state.apply(tokens, time.Now())
+	if !decision.Allowed {
+		return decision, nil
 	}
 
 	// Serialize and save updated state
-	serialized, err := json.Marshal(state)
+	serialized, err := encodeState(state)
 	if err != nil {
-		return fmt.Errorf("marshal error: %w", err)
+		return Decision{}, fmt.Errorf("marshal error: %w", err)
 	}
 
 	err = rdb.Set(ctx, key, serialized, 24*time.Hour).Err()
 	if err != nil {
-		return fmt.Errorf("redis set error: %w", err)
+		return Decision{}, fmt.Errorf("redis set error: %w", err)
 	}
 
-	return nil
+	return decision, nil
+}
+
+// releaseLock deletes lockKey only if it still holds lockValue. It uses
+// WATCH rather than a Lua compare-and-delete because Garnet disables Lua.
+func releaseLock(ctx context.Context, rdb redis.UniversalClient, lockKey string, lockValue string) error {
+	return rdb.Watch(ctx, func(tx *redis.Tx) error {
+		owner, err := tx.Get(ctx, lockKey).Result()
+		if err == redis.Nil || (err == nil && owner != lockValue) {
+			// Expired, or taken over (e.g. after a failover); not ours to delete
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, lockKey)
+			return nil
+		})
+		return err
+	}, lockKey)
 }
 
 func main() {
+	codec, err := codecFromEnv()
+	if err != nil {
+		log.Fatalf("failed to select state codec: %v", err)
+	}
+	stateCodec = codec
+
 	// Create Redis client
-	rdb := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-		DB:   0,
-	})
+	rdb := newRedisClient()
 	defer rdb.Close()
 
 	// Test parameters
 	userID := "test_user"
 	endpointID := "test_endpoint"
-	key := fmt.Sprintf("ratelimit:%s:%s", userID, endpointID)
+	key := limiterKey(userID, endpointID)
 
 	// Initialize state
 	ctx := context.Background()
@@ -157,7 +186,7 @@ func main() {
 			StartTime: time.Now(),
 		}},
 	}
-	serialized, _ := json.Marshal(initialState)
+	serialized, _ := encodeState(initialState)
 	rdb.Set(ctx, key, serialized, 24*time.Hour)
 
 	var wg sync.WaitGroup
@@ -180,7 +209,7 @@ func main() {
 					continue
 				}
 				var state LimiterState
-				if err := json.Unmarshal(val, &state); err != nil {
+				if err := decodeState(val, &state); err != nil {
 					continue
 				}
 				fmt.Printf("\rCurrent counts - Sliding: %d/%d, Fixed: %d/%d",
@@ -201,11 +230,15 @@ func main() {
 			for j := 0; j < 100; j++ {
 				start := time.Now()
 				
-				err := updateLimiterStateWithLock(ctx, rdb, userID, endpointID, 1)
+				d, err := updateLimiterStateWithLock(ctx, rdb, userID, endpointID, 1)
 				if err != nil {
 					log.Printf("Error in routine %d: %v", routineID, err)
 					continue
 				}
+				if !d.Allowed {
+					log.Printf("Rate limited in routine %d: %d/%d left, resets in %v", routineID, d.Remaining, d.Limit, d.ResetAfter)
+					continue
+				}
 				
 				latencyChan <- time.Since(start)
 			}
@@ -220,7 +253,7 @@ func main() {
 	// Print final state
 	val, _ := rdb.Get(ctx, key).Bytes()
 	var finalState LimiterState
-	json.Unmarshal(val, &finalState)
+	decodeState(val, &finalState)
 	fmt.Printf("\n\nFinal State:\n")
 	fmt.Printf("Sliding Window: %d/%d\n", 
 		finalState.SlidingWindows[0].Count, finalState.SlidingWindows[0].Limit)
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -15,12 +15,16 @@ import (
 	Count     int64     `json:"count"`
 	Limit     int64     `json:"limit"`
 	StartTime time.Time `json:"start_time"`
+	// Period is how long the window lasts before its count resets. Zero means
+	// the window never resets, which is how the original experiments behave.
+	Period time.Duration `json:"period,omitempty"`
  }
 
  type FixedWindow struct {
 	Count     int64     `json:"count"`
 	Limit     int64     `json:"limit"`
 	StartTime time.Time `json:"start_time"`
+	Period    time.Duration `json:"period,omitempty"` // same meaning as SlidingWindow.Period
  }
 
  type LimiterState struct {
@@ -28,12 +32,28 @@ import (
 	FixedWindow    []FixedWindow   `json:"fixed_window"`
  }
 
-func UpdateLimiterState3(rdb *redis.Client, userID string, endpointID string, tokens int64) error {
-    key := fmt.Sprintf("ratelimit:%s:%s", userID, endpointID)
-    ctx := context.Background()
+// maxWatchRetries bounds how often a transaction that lost the WATCH race is
+// retried; between attempts it backs off from watchRetryDelay, doubling up to
+// maxWatchRetryDelay, with jitter.
+const (
+    maxWatchRetries    = 50
+    watchRetryDelay    = time.Millisecond
+    maxWatchRetryDelay = 100 * time.Millisecond
+)
+
+func UpdateLimiterState3(ctx context.Context, rdb redis.UniversalClient, userID string, endpointID string, tokens int64) (Decision, error) {
+    key := limiterKey(userID, endpointID)
     
-    // Keep retrying until we succeed
+    // Retry a transaction that lost the race, up to maxWatchRetries times. A
+    // transaction in flight during a failover that hits the demoted primary
+    // (READONLY) or can't reach any primary did not apply, so it is retried
+    // against whichever primary Sentinel reports next, up to
+    // maxFailoverRetries. A connection dropped mid-EXEC may or may not have
+    // applied and is returned to the caller.
+    failoverRetries := 0
+    watchRetries := 0
     for {
+        var decision Decision
         err := rdb.Watch(ctx, func(tx *redis.Tx) error {
             // Get the current state
             val, err := tx.Get(ctx, key).Bytes()
@@ -49,34 +69,20 @@ func UpdateLimiterState3(rdb *redis.Client, userID string, endpointID string, to
                 return fmt.Errorf("redis get error: %w", err)
             } else {
                 // Deserialize existing state
-                if err := json.Unmarshal(val, &state); err != nil {
+                if err := decodeState(val, &state); err != nil {
                     return fmt.Errorf("unmarshal error: %w", err)
                 }
             }
 
-            // Check limits
-            for i := range state.SlidingWindows {
-                if state.SlidingWindows[i].Count + tokens > state.SlidingWindows[i].Limit {
-                    return redis.TxFailedErr
-                }
-            }
-            
-            for i := range state.FixedWindow {
-                if state.FixedWindow[i].Count + tokens > state.FixedWindow[i].Limit {
-                    return redis.TxFailedErr
-                }
-            }
-            
-            // Update counters
-            for i := range state.SlidingWindows {
-                state.SlidingWindows[i].Count += tokens
-            }
-            for i := range state.FixedWindow {
-                state.FixedWindow[i].Count += tokens
+            // Check limits and update counters; a denied request ends the
+            // transaction without writing
+            decision = state.apply(tokens, time.Now())
+            if !decision.Allowed {
+                return nil
             }
             
             // Serialize updated state
-            serialized, err := json.Marshal(state)
+            serialized, err := encodeState(state)
             if err != nil {
                 return fmt.Errorf("marshal error: %w", err)
             }
@@ -91,25 +97,40 @@ func UpdateLimiterState3(rdb *redis.Client, userID string, endpointID string, to
         }, key)
 
         if err == redis.TxFailedErr {
-            // Transaction failed, retry
+            // Transaction failed, retry after a backoff
+            if watchRetries >= maxWatchRetries {
+                return Decision{}, fmt.Errorf("transaction failed after %d retries: %w", maxWatchRetries, err)
+            }
+            delay := min(watchRetryDelay*time.Duration(1<<uint(min(watchRetries, 16))), maxWatchRetryDelay)
+            watchRetries++
+            select {
+            case <-ctx.Done():
+                return Decision{}, fmt.Errorf("context cancelled while retrying transaction: %w", ctx.Err())
+            case <-time.After(time.Duration(float64(delay) * (0.5 + rand.Float64()))):
+            }
+            continue
+        }
+        if isFailoverErr(err) && failoverRetries < maxFailoverRetries {
+            failoverRetries++
+            time.Sleep(failoverRetryDelay)
             continue
         }
-        return err
+        if err != nil {
+            return Decision{}, err
+        }
+        return decision, nil
     }
 }
 
 func main3() {
     // Create Redis client
-    rdb := redis.NewClient(&redis.Options{
-        Addr: "0.0.0.0:6379",
-        DB:   0,
-    })
+    rdb := newRedisClient()
     defer rdb.Close()
 
     // Test key components
     userID := "test_user"
     endpointID := "test_endpoint"
-    key := fmt.Sprintf("ratelimit:%s:%s", userID, endpointID)
+    key := limiterKey(userID, endpointID)
 
     // Initialize state with some limits
     initialState := LimiterState{
@@ -122,7 +143,7 @@ func main3() {
     }
 
     // Initialize the key with initial state
-    serialized, _ := json.Marshal(initialState)
+    serialized, _ := encodeState(initialState)
     rdb.Set(context.Background(), key, serialized, 24*time.Hour)
 
     // Number of concurrent routines and updates per routine
@@ -150,7 +171,7 @@ func main3() {
                 }
                 
                 var state LimiterState
-                if err := json.Unmarshal(val, &state); err != nil {
+                if err := decodeState(val, &state); err != nil {
                     fmt.Printf("Error unmarshaling state: %v\n", err)
                     continue
                 }
@@ -182,7 +203,7 @@ func main3() {
             
             for j := 0; j < updatesPerRoutine; j++ {
                 updateStart := time.Now()
-                err := UpdateLimiterState3(rdb, userID, endpointID, 1)
+                d, err := UpdateLimiterState3(context.Background(), rdb, userID, endpointID, 1)
                 latency := time.Since(updateStart)
                 latencyChan <- latency
 
@@ -190,10 +211,10 @@ func main3() {
                     fmt.Printf("Error in routine %d, update %d: %v\n", routineID, j, err)
                     continue
                 }
-                // if !success {
-                //     fmt.Printf("Rate limit exceeded in routine %d, update %d\n", routineID, j)
-                //     continue
-                // }
+                if !d.Allowed {
+                    fmt.Printf("Rate limit exceeded in routine %d, update %d\n", routineID, j)
+                    continue
+                }
             }
         }(i)
     }
@@ -209,7 +230,7 @@ func main3() {
         fmt.Printf("Error fetching final state: %v\n", err)
     } else {
         var finalState LimiterState
-        if err := json.Unmarshal(val, &finalState); err != nil {
+        if err := decodeState(val, &finalState); err != nil {
             fmt.Printf("Error unmarshaling final state: %v\n", err)
         } else {
             fmt.Printf("\nFinal State:\n")
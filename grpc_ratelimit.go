@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// GRPCRateLimitConfig is what the gRPC interceptors check each RPC against.
+// Each RPC is counted against its full method name, such as
+// "/imagegen.v1.ImageGen/Generate".
+type GRPCRateLimitConfig struct {
+	// Limiters are checked in order, as in RateLimitConfig
+	Limiters []Limiter
+	// Subject is who the RPC is for; an empty subject is Unauthenticated.
+	// Defaults to the x-user-id metadata.
+	Subject func(ctx context.Context) string
+	// Costs are tokens per full method name. Methods not listed cost 1.
+	Costs map[string]int64
+	// FailOpen lets RPCs through when a limiter errors, instead of failing
+	// them with Unavailable.
+	FailOpen bool
+}
+
+// subjectFromMetadata reads the subject from incoming metadata key.
+func subjectFromMetadata(key string) func(ctx context.Context) string {
+	return func(ctx context.Context) string {
+		if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+}
+
+func (cfg *GRPCRateLimitConfig) setDefaults() {
+	if cfg.Subject == nil {
+		cfg.Subject = subjectFromMetadata("x-user-id")
+	}
+}
+
+// admitRPC checks one RPC. It returns the status error to fail the RPC
+// with, or the headers to send and the release to call once it's done.
+func (cfg *GRPCRateLimitConfig) admitRPC(ctx context.Context, method string) (metadata.MD, func(), error) {
+	subject := cfg.Subject(ctx)
+	if subject == "" {
+		return nil, nil, status.Error(codes.Unauthenticated, "missing subject")
+	}
+	tokens, ok := cfg.Costs[method]
+	if !ok {
+		tokens = 1
+	}
+	d, release, err := admit(ctx, cfg.Limiters, subject, method, tokens, cfg.FailOpen)
+	if err != nil {
+		log.Printf("rate limit check failed for %s on %s: %v", subject, method, err)
+		return nil, nil, status.Error(codes.Unavailable, "rate limit check failed")
+	}
+	if !d.Allowed {
+		return nil, nil, resourceExhausted(d)
+	}
+	return rateLimitMetadata(d), release, nil
+}
+
+// resourceExhausted is the status for a denied RPC. Its RetryInfo tells
+// clients that honor it, grpc-go's retry policy among them, when to try
+// again.
+func resourceExhausted(d Decision) error {
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	delay := time.Duration(ceilSeconds(d.ResetAfter)) * time.Second
+	withInfo, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+	if err != nil {
+		return st.Err()
+	}
+	return withInfo.Err()
+}
+
+// rateLimitMetadata carries the RateLimit headers as response metadata.
+func rateLimitMetadata(d Decision) metadata.MD {
+	if d.Remaining < 0 || d.Limit <= 0 {
+		return nil
+	}
+	return metadata.Pairs(
+		"ratelimit-limit", strconv.FormatInt(d.Limit, 10),
+		"ratelimit-remaining", strconv.FormatInt(d.Remaining, 10),
+		"ratelimit-reset", strconv.FormatInt(ceilSeconds(d.ResetAfter), 10),
+	)
+}
+
+// unaryRateLimit checks each unary RPC before its handler runs and releases
+// the RPC's slots when the handler returns.
+func unaryRateLimit(cfg GRPCRateLimitConfig) grpc.UnaryServerInterceptor {
+	cfg.setDefaults()
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, release, err := cfg.admitRPC(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		if md != nil {
+			if err := grpc.SetHeader(ctx, md); err != nil {
+				log.Printf("failed to set rate limit headers: %v", err)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// streamRateLimit checks each stream once, when it opens, and holds its
+// slots until the handler returns, so a concurrency limit bounds how many
+// streams are open rather than how many have been opened recently.
+func streamRateLimit(cfg GRPCRateLimitConfig) grpc.StreamServerInterceptor {
+	cfg.setDefaults()
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, release, err := cfg.admitRPC(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if md != nil {
+			if err := ss.SetHeader(md); err != nil {
+				log.Printf("failed to set rate limit headers: %v", err)
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// retryDelay is the RetryInfo delay in a status error, if there is one.
+func retryDelay(err error) (time.Duration, bool) {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// main33 serves the standard gRPC health service over an in-process bufconn
+// listener with both interceptors: Check (unary) costs 2 tokens against 6
+// per minute, and Watch (a server stream) costs nothing but may have 2 open
+// per subject. It prints the codes, RetryInfo and rate limit headers clients
+// see, and shows a Watch slot coming back once its stream is cancelled.
+func main33() {
+	ctx := context.Background()
+	server, err := startStandinRedis()
+	if err != nil {
+		log.Fatalf("failed to start stand-in: %v", err)
+	}
+	defer server.Close()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+	defer rdb.Close()
+	fns, err := loadLimiterFunctions(ctx, rdb)
+	if err != nil {
+		log.Fatalf("failed to load limiter library: %v", err)
+	}
+
+	const (
+		checkMethod = "/grpc.health.v1.Health/Check"
+		watchMethod = "/grpc.health.v1.Health/Watch"
+	)
+	cfg := GRPCRateLimitConfig{
+		Limiters: []Limiter{
+			newConcurrencyLimiter(fns, 2, time.Minute),
+			newWindowLimiter(rdb, []WindowLimit{{Name: "minute", Limit: 6, Period: time.Minute}}),
+		},
+		Costs: map[string]int64{checkMethod: 2, watchMethod: 0},
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(unaryRateLimit(cfg)), grpc.StreamInterceptor(streamRateLimit(cfg)))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	// Waits for the Watch handlers, so their slots are released before
+	// Redis goes away
+	defer srv.GracefulStop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	as := func(subject string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "x-user-id", subject)
+	}
+	describe := func(header metadata.MD, err error) string {
+		line := status.Code(err).String()
+		if delay, ok := retryDelay(err); ok {
+			line += fmt.Sprintf(" retry after %v", delay)
+		}
+		for _, key := range []string{"ratelimit-limit", "ratelimit-remaining", "ratelimit-reset"} {
+			if v := header.Get(key); len(v) > 0 {
+				line += fmt.Sprintf(" %s=%s", key, v[0])
+			}
+		}
+		return line
+	}
+
+	fmt.Println("=== No subject ===")
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	fmt.Println(describe(nil, err))
+
+	fmt.Println("\n=== 4 Checks at 2 tokens against 6 per minute ===")
+	for i := 0; i < 4; i++ {
+		var header metadata.MD
+		_, err := client.Check(as("customer123"), &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+		fmt.Printf("%d: %s\n", i+1, describe(header, err))
+	}
+
+	fmt.Println("\n=== 3 Watch streams, 2 may be open ===")
+	var cancels []context.CancelFunc
+	for i := 0; i < 3; i++ {
+		streamCtx, cancel := context.WithCancel(as("customer456"))
+		cancels = append(cancels, cancel)
+		stream, err := client.Watch(streamCtx, &healthpb.HealthCheckRequest{})
+		if err == nil {
+			// A stream's status only arrives with its first message
+			_, err = stream.Recv()
+		}
+		fmt.Printf("%d: %s\n", i+1, describe(nil, err))
+	}
+
+	cancels[0]()
+	// The slot comes back when the server sees the cancellation
+	var err4 error
+	for attempt := 0; attempt < 50; attempt++ {
+		streamCtx, cancel := context.WithCancel(as("customer456"))
+		cancels = append(cancels, cancel)
+		stream, err := client.Watch(streamCtx, &healthpb.HealthCheckRequest{})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if err4 = err; status.Code(err) != codes.ResourceExhausted {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Printf("After cancelling one: %s\n", describe(nil, err4))
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
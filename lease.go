@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric"
+	"github.com/redis/go-redis/v9"
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/kv"
+	"github.com/tikv/client-go/v2/txnkv"
+)
+
+// LeasePlan configures leasing for one plan. Each process reserves BlockSize
+// units of Limit at a time from the shared counter, or a bigger request's
+// worth, and serves requests from them locally for at most LeaseTTL, then
+// returns what it didn't use.
+//
+// Reservations never take the shared counter past Limit, so leasing by itself
+// can only under-admit (units parked in another process's lease). The one
+// way to over-admit is a return that lands after the window it was leased
+// from has reset, crediting the new window. Only the Redis store can do
+// that, in the moment between a return's check and the counter expiring;
+// each process has at most one lease per key, so it is bounded by one
+// reservation per process per window (see OverAdmissionBound).
+type LeasePlan struct {
+	Limit     int64
+	BlockSize int64
+	LeaseTTL  time.Duration
+	// Window is how long the shared counter lives before it resets. Leases
+	// never outlive the window they were taken from.
+	Window time.Duration
+}
+
+// OverAdmissionBound is the most a window can be over-admitted by when
+// processes share it and no request is for more than maxTokens.
+func (p LeasePlan) OverAdmissionBound(processes int, maxTokens int64) int64 {
+	return max(p.BlockSize, maxTokens) * int64(processes)
+}
+
+// leaseStore is the shared counter leases are reserved from.
+type leaseStore interface {
+	// reserve adds up to n units to key's counter for the current window
+	// without taking it past limit, and returns how many were granted and
+	// when that window ends (zero if it doesn't).
+	reserve(ctx context.Context, key string, n int64, limit int64, window time.Duration) (int64, time.Time, error)
+	// giveBack returns n unused units to the window ending at windowEnd. It
+	// does nothing once that window's counter is gone.
+	giveBack(ctx context.Context, key string, n int64, windowEnd time.Time) error
+}
+
+// redisLeaseStore reserves with INCRBY and hands back any excess with
+// giveBackScript. Concurrent reservations see each other's not-yet-returned
+// excess, which only makes them grant less, never more.
+type redisLeaseStore struct {
+	rdb redis.UniversalClient
+}
+
+// giveBackScript takes units off a counter that still exists. DECRBY on an
+// expired one would create it again, negative and without a TTL, crediting
+// every window after it.
+// KEYS[1] = counter, ARGV[1] = units
+// Returns the count after, or -1 if the counter was gone.
+var giveBackScript = redis.NewScript(`
+	local count = redis.call('GET', KEYS[1])
+	if not count then
+		return -1
+	end
+	count = tonumber(count) - tonumber(ARGV[1])
+	if count < 0 then
+		count = 0
+	end
+	redis.call('SET', KEYS[1], count, 'KEEPTTL')
+	return count
+`)
+
+func (s redisLeaseStore) reserve(ctx context.Context, key string, n int64, limit int64, window time.Duration) (int64, time.Time, error) {
+	pipe := s.rdb.Pipeline()
+	incr := pipe.IncrBy(ctx, key, n)
+	// Only sets the TTL when the counter was just created
+	pipe.ExpireNX(ctx, key, window)
+	pttl := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to reserve: %w", err)
+	}
+	granted := grantedOf(incr.Val(), n, limit)
+	if granted < n {
+		if err := giveBackScript.Run(ctx, s.rdb, []string{key}, n-granted).Err(); err != nil {
+			return 0, time.Time{}, fmt.Errorf("failed to return excess: %w", err)
+		}
+	}
+	var windowEnd time.Time
+	if pttl.Val() > 0 {
+		windowEnd = time.Now().Add(pttl.Val())
+	}
+	return granted, windowEnd, nil
+}
+
+func (s redisLeaseStore) giveBack(ctx context.Context, key string, n int64, windowEnd time.Time) error {
+	return giveBackScript.Run(ctx, s.rdb, []string{key}, n).Err()
+}
+
+// olricLeaseStore does the same with Olric's Incr/Decr. Olric can't expire a
+// counter it increments, so each window has its own counter, named after
+// when the window ends, and windows are aligned to multiples of their
+// length. A counter is kept for a window after its own so a return racing
+// its end still finds it.
+type olricLeaseStore struct {
+	dm olric.DMap
+}
+
+// alignedWindowEnd is the end of the window, aligned to a multiple of its
+// length, that now falls in.
+func alignedWindowEnd(now time.Time, window time.Duration) time.Time {
+	w := window.Milliseconds()
+	return time.UnixMilli((now.UnixMilli()/w + 1) * w)
+}
+
+func olricWindowKey(key string, windowEnd time.Time) string {
+	return key + ":" + strconv.FormatInt(windowEnd.UnixMilli(), 10)
+}
+
+func (s olricLeaseStore) reserve(ctx context.Context, key string, n int64, limit int64, window time.Duration) (int64, time.Time, error) {
+	var windowEnd time.Time
+	if window > 0 {
+		windowEnd = alignedWindowEnd(time.Now(), window)
+		key = olricWindowKey(key, windowEnd)
+	}
+	total, err := s.dm.Incr(ctx, key, int(n))
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to reserve: %w", err)
+	}
+	if window > 0 {
+		if err := s.dm.Expire(ctx, key, time.Until(windowEnd)+window); err != nil {
+			return 0, time.Time{}, fmt.Errorf("failed to set window expiry: %w", err)
+		}
+	}
+	granted := grantedOf(int64(total), n, limit)
+	if granted < n {
+		if _, err := s.dm.Decr(ctx, key, int(n-granted)); err != nil {
+			return 0, time.Time{}, fmt.Errorf("failed to return excess: %w", err)
+		}
+	}
+	return granted, windowEnd, nil
+}
+
+func (s olricLeaseStore) giveBack(ctx context.Context, key string, n int64, windowEnd time.Time) error {
+	if !windowEnd.IsZero() {
+		key = olricWindowKey(key, windowEnd)
+	}
+	_, err := s.dm.Decr(ctx, key, int(n))
+	return err
+}
+
+// tikvLeaseStore reserves inside a pessimistic transaction, so it can grant
+// exactly what is left without overshooting first. TiKV transactions can't
+// expire keys either, so the counter is stored with the end of its window
+// and starts over when a reservation finds that past.
+type tikvLeaseStore struct {
+	client *txnkv.Client
+}
+
+// tikvCounter is a stored counter: "count", or "count/end" with the end of
+// its window in Unix ms.
+type tikvCounter struct {
+	count int64
+	end   time.Time
+}
+
+func parseTiKVCounter(value []byte) (tikvCounter, error) {
+	countPart, endPart, hasEnd := strings.Cut(string(value), "/")
+	var c tikvCounter
+	var err error
+	if c.count, err = strconv.ParseInt(countPart, 10, 64); err != nil {
+		return tikvCounter{}, err
+	}
+	if hasEnd {
+		ms, err := strconv.ParseInt(endPart, 10, 64)
+		if err != nil {
+			return tikvCounter{}, err
+		}
+		c.end = time.UnixMilli(ms)
+	}
+	return c, nil
+}
+
+func (c tikvCounter) bytes() []byte {
+	s := strconv.FormatInt(c.count, 10)
+	if !c.end.IsZero() {
+		s += "/" + strconv.FormatInt(c.end.UnixMilli(), 10)
+	}
+	return []byte(s)
+}
+
+func (s tikvLeaseStore) reserve(ctx context.Context, key string, n int64, limit int64, window time.Duration) (int64, time.Time, error) {
+	var granted int64
+	var windowEnd time.Time
+	err := s.update(ctx, key, func(c tikvCounter) (tikvCounter, bool) {
+		if now := time.Now(); window > 0 && !now.Before(c.end) {
+			c = tikvCounter{end: time.UnixMilli(now.Add(window).UnixMilli())}
+		}
+		granted = min(n, max(limit-c.count, 0))
+		c.count += granted
+		windowEnd = c.end
+		return c, true
+	})
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to reserve: %w", err)
+	}
+	return granted, windowEnd, nil
+}
+
+func (s tikvLeaseStore) giveBack(ctx context.Context, key string, n int64, windowEnd time.Time) error {
+	return s.update(ctx, key, func(c tikvCounter) (tikvCounter, bool) {
+		if !c.end.Equal(windowEnd) {
+			// The window has started over since; the units went with it
+			return c, false
+		}
+		c.count = max(c.count-n, 0)
+		return c, true
+	})
+}
+
+// update applies fn to the counter at key in one pessimistic transaction,
+// retrying write conflicts like updateLimiterState8. fn reports whether
+// there is anything to write.
+func (s tikvLeaseStore) update(ctx context.Context, key string, fn func(tikvCounter) (tikvCounter, bool)) error {
+	k := []byte(key)
+	const maxRetries = 3
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		txn, err := s.client.Begin()
+		if err != nil {
+			return fmt.Errorf("begin txn failed: %w", err)
+		}
+		txn.SetPessimistic(true)
+		if err := txn.LockKeysWithWaitTime(ctx, kv.LockAlwaysWait, k); err != nil {
+			txn.Rollback()
+			return fmt.Errorf("failed to lock key: %w", err)
+		}
+
+		var c tikvCounter
+		value, err := txn.Get(ctx, k)
+		if err != nil && !tikverr.IsErrNotFound(err) {
+			txn.Rollback()
+			return fmt.Errorf("failed to get current value: %w", err)
+		}
+		if err == nil {
+			if c, err = parseTiKVCounter(value); err != nil {
+				txn.Rollback()
+				return fmt.Errorf("failed to parse counter: %w", err)
+			}
+		}
+
+		c, write := fn(c)
+		if !write {
+			txn.Rollback()
+			return nil
+		}
+		if err := txn.Set(k, c.bytes()); err != nil {
+			txn.Rollback()
+			return fmt.Errorf("failed to set new value: %w", err)
+		}
+		if err := txn.Commit(ctx); err != nil {
+			txn.Rollback()
+			if tikverr.IsErrWriteConflict(err) && attempt < maxRetries {
+				continue
+			}
+			return fmt.Errorf("transaction commit failed: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("update failed after %d retries", maxRetries)
+}
+
+// grantedOf works out how much of an n-unit increment that brought a counter
+// to total fits under limit.
+func grantedOf(total int64, n int64, limit int64) int64 {
+	over := total - limit
+	switch {
+	case over <= 0:
+		return n
+	case over >= n:
+		return 0
+	default:
+		return n - over
+	}
+}
+
+// lease is this process's block of units for one key.
+type lease struct {
+	mu        sync.Mutex
+	remaining int64
+	expires   time.Time
+	// windowEnd is when the shared counter the units came from resets; units
+	// are not handed back after it.
+	windowEnd time.Time
+	// exhausted means the last reservation got less than a full block, so
+	// the shared counter is (nearly) spent and requests the lease can't cover
+	// are denied locally until it expires instead of each asking the store.
+	exhausted bool
+	// evicted means the lease was dropped from leasingLimiter.leases while
+	// idle; whoever still holds it has to look the key up again.
+	evicted bool
+}
+
+// leasingLimiter admits requests from locally held leases and only goes to the
+// shared store to take a new block or return an old one.
+type leasingLimiter struct {
+	store leaseStore
+	plan  LeasePlan
+
+	mu     sync.Mutex
+	leases map[string]*lease
+	// swept is when idle leases were last evicted
+	swept time.Time
+
+	roundTrips atomic.Int64
+}
+
+func newLeasingLimiter(store leaseStore, plan LeasePlan) *leasingLimiter {
+	return &leasingLimiter{store: store, plan: plan, leases: make(map[string]*lease)}
+}
+
+// Allow decides whether tokens can be spent for userID/endpointID. The
+// Decision's Remaining is what is left of this process's lease, and
+// ResetAfter runs to the end of the window the lease was taken from.
+func (l *leasingLimiter) Allow(ctx context.Context, userID string, endpointID string, tokens int64) (Decision, error) {
+	key := windowKey("leased", userID, endpointID)
+	now := time.Now()
+	var ls *lease
+	for {
+		l.mu.Lock()
+		ls = l.leases[key]
+		if ls == nil {
+			ls = &lease{}
+			l.leases[key] = ls
+		}
+		sweep := now.Sub(l.swept) >= l.plan.LeaseTTL
+		if sweep {
+			l.swept = now
+		}
+		l.mu.Unlock()
+		if sweep {
+			go l.sweep(context.WithoutCancel(ctx), now)
+		}
+
+		// Held across the reservation, so one goroutine refills for the others
+		ls.mu.Lock()
+		if !ls.evicted {
+			break
+		}
+		ls.mu.Unlock()
+	}
+	defer ls.mu.Unlock()
+
+	decide := func(allowed bool) (Decision, error) {
+		d := Decision{Allowed: allowed, Limit: l.plan.Limit, Remaining: ls.remaining}
+		if !ls.windowEnd.IsZero() {
+			d.ResetAfter = max(ls.windowEnd.Sub(now), 0)
+		}
+		return d, nil
+	}
+
+	if now.Before(ls.expires) {
+		if ls.remaining >= tokens {
+			ls.remaining -= tokens
+			return decide(true)
+		}
+		if ls.exhausted {
+			return decide(false)
+		}
+	}
+
+	if err := l.returnLocked(ctx, key, ls, now); err != nil {
+		return Decision{}, err
+	}
+
+	block := max(l.plan.BlockSize, tokens)
+	granted, windowEnd, err := l.store.reserve(ctx, key, block, l.plan.Limit, l.plan.Window)
+	l.roundTrips.Add(1)
+	if err != nil {
+		return Decision{}, err
+	}
+	ls.remaining = granted
+	ls.exhausted = granted < block
+	ls.expires = now.Add(l.plan.LeaseTTL)
+	ls.windowEnd = windowEnd
+	if !windowEnd.IsZero() && windowEnd.Before(ls.expires) {
+		ls.expires = windowEnd
+	}
+
+	if ls.remaining < tokens {
+		return decide(false)
+	}
+	ls.remaining -= tokens
+	return decide(true)
+}
+
+// Release is a no-op: leased units go back when the lease does.
+func (l *leasingLimiter) Release(ctx context.Context, userID string, endpointID string, leaseID string) error {
+	return nil
+}
+
+// returnLocked hands back whatever is left of ls, unless its window has
+// already reset. The caller holds ls.mu.
+func (l *leasingLimiter) returnLocked(ctx context.Context, key string, ls *lease, now time.Time) error {
+	unused := ls.remaining
+	ls.remaining = 0
+	if unused == 0 || (!ls.windowEnd.IsZero() && !now.Before(ls.windowEnd)) {
+		return nil
+	}
+	l.roundTrips.Add(1)
+	if err := l.store.giveBack(ctx, key, unused, ls.windowEnd); err != nil {
+		return fmt.Errorf("failed to return %d leased units: %w", unused, err)
+	}
+	return nil
+}
+
+// sweep evicts leases that expired before now, returning their leftovers,
+// so keys that stop getting requests don't stay in leases for good. Leases
+// in use are skipped until the next sweep.
+func (l *leasingLimiter) sweep(ctx context.Context, now time.Time) {
+	l.mu.Lock()
+	idle := make(map[string]*lease)
+	for key, ls := range l.leases {
+		idle[key] = ls
+	}
+	l.mu.Unlock()
+
+	for key, ls := range idle {
+		if !ls.mu.TryLock() {
+			continue
+		}
+		if now.Before(ls.expires) {
+			ls.mu.Unlock()
+			continue
+		}
+		if err := l.returnLocked(ctx, key, ls, now); err != nil {
+			ls.mu.Unlock()
+			log.Printf("failed to evict lease %s: %v", key, err)
+			continue
+		}
+		ls.evicted = true
+		ls.mu.Unlock()
+
+		l.mu.Lock()
+		if l.leases[key] == ls {
+			delete(l.leases, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Close returns every unused unit, as a process should on shutdown.
+func (l *leasingLimiter) Close(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, ls := range l.leases {
+		ls.mu.Lock()
+		err := l.returnLocked(ctx, key, ls, now)
+		ls.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// main18 runs four "processes" (leasing limiters sharing one store) with 10
+// goroutines each against a 500-unit plan, on a Redis stand-in and on
+// embedded Olric. It prints admissions, shared-store round-trips and the
+// counter after every process has returned its leftovers.
+func main18() {
+	const processes = 4
+	ctx := context.Background()
+	userID := "test_user"
+	endpointID := "test_endpoint"
+	plan := LeasePlan{Limit: 500, BlockSize: 20, LeaseTTL: time.Second, Window: 24 * time.Hour}
+
+	server, err := startStandinRedis()
+	if err != nil {
+		log.Fatalf("failed to start stand-in: %v", err)
+	}
+	defer server.Close()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+	defer rdb.Close()
+
+	dm, shutdown, err := startOlric("leases")
+	if err != nil {
+		log.Fatalf("failed to start Olric: %v", err)
+	}
+	defer shutdown()
+
+	key := windowKey("leased", userID, endpointID)
+	backends := []struct {
+		name  string
+		store leaseStore
+		count func() int64
+	}{
+		{"redis", redisLeaseStore{rdb: rdb}, func() int64 {
+			n, _ := rdb.Get(ctx, key).Int64()
+			return n
+		}},
+		{"olric", olricLeaseStore{dm: dm}, func() int64 {
+			v, err := dm.Get(ctx, olricWindowKey(key, alignedWindowEnd(time.Now(), plan.Window)))
+			if err != nil {
+				return 0
+			}
+			n, _ := v.Int64()
+			return n
+		}},
+	}
+
+	fmt.Printf("Plan: limit %d, block %d, over-admission bound with %d processes: %d\n",
+		plan.Limit, plan.BlockSize, processes, plan.OverAdmissionBound(processes, 1))
+	fmt.Printf("%-8s %8s %8s %12s %10s %12s\n", "backend", "allowed", "denied", "round-trips", "counter", "total time")
+	for _, backend := range backends {
+		limiters := make([]*leasingLimiter, processes)
+		for i := range limiters {
+			limiters[i] = newLeasingLimiter(backend.store, plan)
+		}
+
+		var allowed, denied atomic.Int64
+		var wg sync.WaitGroup
+		startTime := time.Now()
+		for _, limiter := range limiters {
+			for i := 0; i < numRoutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < updatesPerRoutine/processes; j++ {
+						d, err := limiter.Allow(ctx, userID, endpointID, 1)
+						switch {
+						case err != nil:
+							log.Printf("Error: %v", err)
+						case d.Allowed:
+							allowed.Add(1)
+						default:
+							denied.Add(1)
+						}
+					}
+				}()
+			}
+		}
+		wg.Wait()
+		totalTime := time.Since(startTime)
+
+		var roundTrips int64
+		for _, limiter := range limiters {
+			if err := limiter.Close(ctx); err != nil {
+				log.Printf("Error returning leases: %v", err)
+			}
+			roundTrips += limiter.roundTrips.Load()
+		}
+		fmt.Printf("%-8s %8d %8d %12d %10d %12v\n",
+			backend.name, allowed.Load(), denied.Load(), roundTrips, backend.count(), totalTime)
+	}
+}
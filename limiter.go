@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Limiter is what request-facing code checks before doing tokens' worth of
+// work for userID on endpointID. An allowed Decision with a LeaseID holds a
+// slot, which Release gives back once the work is done.
+type Limiter interface {
+	Allow(ctx context.Context, userID string, endpointID string, tokens int64) (Decision, error)
+	Release(ctx context.Context, userID string, endpointID string, leaseID string) error
+}
+
+// windowLimiter enforces a plan of windows with one script call per check.
+type windowLimiter struct {
+	rdb  redis.UniversalClient
+	plan []WindowLimit
+}
+
+func newWindowLimiter(rdb redis.UniversalClient, plan []WindowLimit) *windowLimiter {
+	return &windowLimiter{rdb: rdb, plan: plan}
+}
+
+func (l *windowLimiter) Allow(ctx context.Context, userID string, endpointID string, tokens int64) (Decision, error) {
+	d, _, err := updateLimiterState10(ctx, l.rdb, userID, endpointID, l.plan, tokens)
+	return d, err
+}
+
+// Release is a no-op: spent units only come back when their window resets.
+func (l *windowLimiter) Release(ctx context.Context, userID string, endpointID string, leaseID string) error {
+	return nil
+}
+
+// adjuster is a Limiter that can correct units it has already counted, for
+// work that turned out to cost more or less than it was admitted for.
+type adjuster interface {
+	// Adjust adds delta, which may be negative, to what was spent age ago
+	Adjust(ctx context.Context, userID string, endpointID string, delta int64, age time.Duration) (Decision, error)
+}
+
+// adjustWindowsScript adds a delta to windows that are still the ones the
+// units were spent in. A counter that started after that belongs to a later
+// window, which they were never counted against.
+// KEYS[i] = counter for window i
+// ARGV[1] = delta, ARGV[2] = how long ago the units were spent, in ms
+// ARGV[2i+1] = limit of window i, ARGV[2i+2] = its period in ms
+// Returns the same shape as windowsScript, allowed meaning no window is over.
+var adjustWindowsScript = redis.NewScript(`
+	local delta = tonumber(ARGV[1])
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	local spent = now - tonumber(ARGV[2])
+
+	local allowed = 1
+	local windows = {}
+	for i, key in ipairs(KEYS) do
+		local limit = tonumber(ARGV[2 * i + 1])
+		local count = tonumber(redis.call('GET', key) or '0')
+		local pttl = redis.call('PTTL', key)
+		if pttl > 0 and now + pttl - tonumber(ARGV[2 * i + 2]) <= spent then
+			count = redis.call('INCRBY', key, delta)
+			if count < 0 then
+				redis.call('SET', key, 0, 'KEEPTTL')
+				count = 0
+			end
+		end
+		if count > limit then
+			allowed = 0
+		end
+		windows[i] = {count, limit, math.max(limit - count, 0), pttl}
+	end
+
+	return {allowed, windows}
+`)
+
+// Adjust corrects the windows units were taken from age ago. Windows that
+// have reset since are left alone.
+func (l *windowLimiter) Adjust(ctx context.Context, userID string, endpointID string, delta int64, age time.Duration) (Decision, error) {
+	keys := make([]string, len(l.plan))
+	args := []interface{}{delta, age.Milliseconds()}
+	for i, w := range l.plan {
+		keys[i] = windowKey(w.Name, userID, endpointID)
+		args = append(args, w.Limit, w.Period.Milliseconds())
+	}
+	result, err := adjustWindowsScript.Run(ctx, l.rdb, keys, args...).Result()
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to adjust windows: %w", err)
+	}
+	d, _, err := parseWindowsReply(l.plan, result)
+	return d, err
+}
+
+// concurrencyLimiter allows at most limit requests in flight per user and
+// endpoint. A slot whose holder never releases it lapses after ttl, so ttl
+// should be longer than any request takes.
+type concurrencyLimiter struct {
+	fns   *limiterFunctions
+	limit int64
+	ttl   time.Duration
+}
+
+func newConcurrencyLimiter(fns *limiterFunctions, limit int64, ttl time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{fns: fns, limit: limit, ttl: ttl}
+}
+
+// Allow takes one slot whatever tokens is; concurrency counts requests, not
+// their cost.
+func (l *concurrencyLimiter) Allow(ctx context.Context, userID string, endpointID string, tokens int64) (Decision, error) {
+	leaseID := uuid.NewString()
+	ok, held, err := l.fns.acquire(ctx, windowKey("concurrency", userID, endpointID), leaseID, l.limit, l.ttl)
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to acquire concurrency slot: %w", err)
+	}
+	d := Decision{Allowed: ok, Limit: l.limit, Remaining: max(l.limit-held, 0)}
+	if ok {
+		d.LeaseID = leaseID
+	}
+	return d, nil
+}
+
+func (l *concurrencyLimiter) Release(ctx context.Context, userID string, endpointID string, leaseID string) error {
+	if err := l.fns.release(ctx, windowKey("concurrency", userID, endpointID), leaseID); err != nil {
+		return fmt.Errorf("failed to release concurrency slot: %w", err)
+	}
+	return nil
+}
+
+// entitlementLimiter allows a request while the user's entitlement to
+// feature has access. It only reads the balance; usage is taken off it when
+// the work is logged.
+type entitlementLimiter struct {
+	svc     *ImageGenService
+	feature string
+}
+
+// limiter checks feature's entitlement for whichever user a request is for.
+func (s *ImageGenService) limiter(feature string) Limiter {
+	return entitlementLimiter{svc: s, feature: feature}
+}
+
+func (l entitlementLimiter) Allow(ctx context.Context, userID string, endpointID string, tokens int64) (Decision, error) {
+	ent, err := l.svc.lookupEntitlement(ctx, userID, l.feature)
+	if err != nil {
+		if errors.Is(err, ErrEntitlementNotFound) {
+			// No entitlement means no access, not an outage
+			return Decision{}, nil
+		}
+		return Decision{}, err
+	}
+	d := Decision{Allowed: ent.HasAccess, Remaining: -1}
+	if ent.Kind == EntitlementMetered {
+		d.Limit = int64(ent.Balance + ent.Usage - ent.Overage)
+		d.Remaining = int64(ent.Balance)
+		// Only a denial has to say when to come back, so only a denial reads
+		// the usage period. Failing to is logged rather than failing the check
+		if !d.Allowed {
+			end, err := l.svc.usagePeriodEnd(ctx, userID, l.feature)
+			if err != nil {
+				log.Printf("failed to read usage period of %s/%s: %v", userID, l.feature, err)
+			} else if !end.IsZero() {
+				d.ResetAfter = max(time.Until(end), 0)
+			}
+		}
+	}
+	return d, nil
+}
+
+func (l entitlementLimiter) Release(ctx context.Context, userID string, endpointID string, leaseID string) error {
+	return nil
+}
+
+// admit checks one request against limiters in order. An allowed Decision is
+// the one with the least room left; a denied one is the limiter's that
+// denied it. release gives back the slots the request holds and has to be
+// called once it's done; after a denial or an error there are none left to
+// give back, and units earlier limiters counted are refunded if they are
+// adjusters. An allowed Decision's LeaseID is set if the request holds any
+// slots. With failOpen a limiter that errors is skipped instead.
+func admit(ctx context.Context, limiters []Limiter, userID string, endpointID string, tokens int64, failOpen bool) (d Decision, release func(), err error) {
+	type heldSlot struct {
+		limiter Limiter
+		leaseID string
+	}
+	type spentUnits struct {
+		adjuster adjuster
+		at       time.Time
+	}
+	var held []heldSlot
+	var spent []spentUnits
+	refund := func() {
+		ctx := context.WithoutCancel(ctx)
+		for _, s := range spent {
+			if _, err := s.adjuster.Adjust(ctx, userID, endpointID, -tokens, time.Since(s.at)); err != nil {
+				log.Printf("failed to refund %d units to %s on %s: %v", tokens, userID, endpointID, err)
+			}
+		}
+	}
+	release = func() {
+		// The caller going away mustn't keep its slots held
+		ctx := context.WithoutCancel(ctx)
+		for _, h := range held {
+			if err := h.limiter.Release(ctx, userID, endpointID, h.leaseID); err != nil {
+				log.Printf("failed to release slot for %s on %s: %v", userID, endpointID, err)
+			}
+		}
+		held = nil
+	}
+
+	tightest := Decision{Allowed: true, Remaining: -1}
+	for _, l := range limiters {
+		d, err := l.Allow(ctx, userID, endpointID, tokens)
+		if err != nil {
+			if failOpen {
+				log.Printf("rate limit check failed for %s on %s, allowing: %v", userID, endpointID, err)
+				continue
+			}
+			release()
+			refund()
+			return Decision{}, release, err
+		}
+		if !d.Allowed {
+			release()
+			refund()
+			return d, release, nil
+		}
+		if d.LeaseID != "" {
+			held = append(held, heldSlot{limiter: l, leaseID: d.LeaseID})
+		}
+		if a, ok := l.(adjuster); ok && tokens > 0 {
+			spent = append(spent, spentUnits{adjuster: a, at: time.Now()})
+		}
+		if d.Remaining >= 0 && (tightest.Remaining < 0 || d.Remaining < tightest.Remaining) {
+			tightest = d
+		}
+	}
+	tightest.LeaseID = ""
+	if len(held) > 0 {
+		tightest.LeaseID = held[0].leaseID
+	}
+	return tightest, release, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WindowLimit is one window of a plan: at most Limit units per Period.
+type WindowLimit struct {
+	Name   string
+	Limit  int64
+	Period time.Duration
+}
+
+// WindowResult is what one window looks like after a check.
+type WindowResult struct {
+	Name       string
+	Count      int64
+	Limit      int64
+	Remaining  int64
+	ResetAfter time.Duration
+}
+
+// windowsScript checks and increments any number of windows atomically. It
+// is the limiter library's check_incr sent with EVAL, so there's one copy of
+// the Lua.
+// KEYS[i] = counter for window i
+// ARGV[1] = increment amount
+// ARGV[2i] = limit of window i
+// ARGV[2i+1] = TTL of window i in milliseconds, set when its counter is created
+// Returns {allowed, {{count, limit, remaining, pttl}, ...}}
+var windowsScript = redis.NewScript(limiterEvalScript(limiterFunctionBody("check_incr")))
+
+// updateLimiterState10 enforces a whole plan in one round-trip. Each window
+// gets its own counter key, limit and TTL; the Decision describes the window
+// with the least room left.
+func updateLimiterState10(ctx context.Context, rdb redis.UniversalClient, userID string, endpointID string, plan []WindowLimit, tokens int64) (Decision, []WindowResult, error) {
+	keys := make([]string, len(plan))
+	args := []interface{}{tokens}
+	for i, w := range plan {
+		keys[i] = windowKey(w.Name, userID, endpointID)
+		args = append(args, w.Limit, w.Period.Milliseconds())
+	}
+
+	result, err := windowsScript.Run(ctx, rdb, keys, args...).Result()
+	if err != nil {
+		return Decision{}, nil, fmt.Errorf("failed to run script: %w", err)
+	}
+	return parseWindowsReply(plan, result)
+}
+
+// parseWindowsReply reads {allowed, {{count, limit, remaining, pttl}, ...}},
+// the reply of windowsScript and of anything else implementing its contract.
+func parseWindowsReply(plan []WindowLimit, result interface{}) (Decision, []WindowResult, error) {
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return Decision{}, nil, fmt.Errorf("unexpected script result format")
+	}
+	windows, ok := values[1].([]interface{})
+	if !ok || len(windows) != len(plan) {
+		return Decision{}, nil, fmt.Errorf("unexpected script result format")
+	}
+
+	decision := Decision{Allowed: values[0] == int64(1), Remaining: -1}
+	results := make([]WindowResult, len(plan))
+	for i, w := range windows {
+		fields, ok := w.([]interface{})
+		if !ok || len(fields) != 4 {
+			return Decision{}, nil, fmt.Errorf("unexpected script result format")
+		}
+		count, _ := fields[0].(int64)
+		limit, _ := fields[1].(int64)
+		remaining, _ := fields[2].(int64)
+		pttl, _ := fields[3].(int64)
+
+		// -2 (no counter yet) and -1 (no TTL) both mean nothing to wait for
+		resetAfter := time.Duration(0)
+		if pttl > 0 {
+			resetAfter = time.Duration(pttl) * time.Millisecond
+		}
+		results[i] = WindowResult{
+			Name:       plan[i].Name,
+			Count:      count,
+			Limit:      limit,
+			Remaining:  remaining,
+			ResetAfter: resetAfter,
+		}
+		if decision.Remaining < 0 || remaining < decision.Remaining {
+			decision.Limit = limit
+			decision.Remaining = remaining
+			decision.ResetAfter = resetAfter
+		}
+	}
+	if decision.Remaining < 0 {
+		decision.Remaining = 0
+	}
+	return decision, results, nil
+}
+
+// main15 enforces a per-minute, per-3-hours and per-day plan from 10
+// goroutines. The per-minute window is the first to run out, so it is the one
+// the Decision reports.
+func main15() {
+	ctx := context.Background()
+	userID := "test_user"
+	endpointID := "test_endpoint"
+
+	server, err := startStandinRedis()
+	if err != nil {
+		log.Fatalf("failed to start stand-in: %v", err)
+	}
+	defer server.Close()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+	defer rdb.Close()
+
+	plan := []WindowLimit{
+		{Name: "minute", Limit: 100, Period: time.Minute},
+		{Name: "3hours", Limit: 300, Period: 3 * time.Hour},
+		{Name: "day", Limit: 500, Period: 24 * time.Hour},
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var allowed, denied int
+	var last Decision
+	var lastWindows []WindowResult
+	for i := 0; i < numRoutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updatesPerRoutine; j++ {
+				decision, windows, err := updateLimiterState10(ctx, rdb, userID, endpointID, plan, 1)
+				if err != nil {
+					log.Printf("Error: %v", err)
+					continue
+				}
+				mu.Lock()
+				if decision.Allowed {
+					allowed++
+				} else {
+					denied++
+				}
+				last, lastWindows = decision, windows
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	fmt.Printf("Allowed: %d, Denied: %d\n", allowed, denied)
+	fmt.Printf("Last decision: allowed=%v limit=%d remaining=%d reset after %v\n",
+		last.Allowed, last.Limit, last.Remaining, last.ResetAfter.Round(time.Second))
+	for _, w := range lastWindows {
+		fmt.Printf("  %-7s %4d/%-4d remaining %4d, resets in %v\n",
+			w.Name, w.Count, w.Limit, w.Remaining, w.ResetAfter.Round(time.Second))
+	}
+}
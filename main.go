@@ -4,13 +4,13 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 
-	cloudevents "github.com/cloudevents/sdk-go/v2/event"
 	openmeter "github.com/openmeterio/openmeter/api/client/go"
 )
 
@@ -18,25 +18,52 @@ type ImageGenService struct {
     client *openmeter.ClientWithResponses
     feature string
     subject string
+    // batcher, if set, makes LogUsage queue events instead of sending each one
+    batcher *usageBatcher
+    // dedupe drops events LogUsage has already sent; nil sends everything
+    dedupe *usageDeduper
+    // checkTimeout bounds CheckAll; zero leaves it to the caller's context
+    checkTimeout time.Duration
+    // failOpen makes CheckAll allow features whose entitlement can't be read
+    failOpen bool
+    // cache, if set, serves entitlement reads from memory
+    cache *entitlementCache
+    // periodEnds holds usagePeriodEnd's reads by subject/feature
+    periodEnds sync.Map
 }
 
+// NewImageGenService talks to OPENMETER_URL, or OpenMeter Cloud if it isn't
+// set, with the default client settings.
 func NewImageGenService(apiKey string) (*ImageGenService, error) {
-	client, err := openmeter.NewAuthClientWithResponses("https://openmeter.cloud", apiKey)
+	cfg := openMeterConfigFromEnv()
+	cfg.APIKey = apiKey
+	return NewImageGenServiceWithConfig(cfg)
+}
+
+func NewImageGenServiceWithConfig(cfg OpenMeterConfig) (*ImageGenService, error) {
+	client, err := newOpenMeterClient(cfg)
     if err != nil {
-        return nil, fmt.Errorf("failed to create client: %w", err)
+        return nil, err
 
     }
 
-    return &ImageGenService{
+    svc := &ImageGenService{
         client: client,
-        feature: "image-gen-endpoint",
-        subject: "customer-123",
-    }, nil
+        feature: "gputimecheck",
+        subject: "customer123",
+        dedupe: newUsageDeduper(10 * time.Minute),
+        checkTimeout: 2 * time.Second,
+    }
+    svc.cache = newEntitlementCache(svc.entitlement, 5 * time.Second, defaultProvisioningSpec)
+    return svc, nil
 }
 
 // Meters are better called 'counters', and instead of metering we are 'logging usage'.
 // 'Meters' are just usage logs.
-func (s *ImageGenService) LogUsage(ctx context.Context) (bool, error) {
+//
+// LogUsage sends ev, with the service's subject if ev has none. It returns
+// false without sending if ev's (source, ID) was already logged.
+func (s *ImageGenService) LogUsage(ctx context.Context, ev UsageEvent) (bool, error) {
 	// TO DO: 
 	// create counters (meters)
 	// create a customer-id (subject)
@@ -60,41 +87,37 @@ func (s *ImageGenService) LogUsage(ctx context.Context) (bool, error) {
 	// Unfortunately we are also missing (1) concurrency counts, and (2) quota (credits)
 	// Tyke has a single rate-limiter, throttling, and quota.
 
-	e := cloudevents.New()
-
-	e.SetTime(time.Now())
-
-	// Use unique IDs for each event.
-	// Let's call this request ID
-	e.SetID(uuid.NewString())
-
-	// Set the event source for an identifier of the reporting service.
-	// Events are deduplicated based on the source and ID.
-	e.SetSource("cozy-creator")
-
-	// This is better called 'endpointID'. When you create a meter, you can set its 'event type'.
-	// So if you log an event with type 'image-gen' then all meters with that event-type will be
-	// updated.
-	// More abstractly, you could think of this as an 'eventType', and meters operating on
-	// the number of allowed occurences of that event, such as a 'failed generation' meter; you
-	// might sent the event-type as 'failed-genreation', and create a meter which only allows
-	// 5 failed genreations per hour.
-	e.SetType("text2media")
-
-	// Set the event subject (e.g. the customer ID). Meter values are aggregated by subjects.
-	// This is better called 'customerID'.
-	e.SetSubject("customer123")
-
-	// Set the event data, including the valueProperty and groupBy fields.
-	e.SetData("application/json", map[string]string{
-		"gpu_time": "30",
-		"outputs": "4",
-	})
-	
+	ev = ev.withDefaults(s.subject)
+	if err := ev.Validate(); err != nil {
+		return false, fmt.Errorf("invalid usage event: %w", err)
+	}
+	if !s.dedupe.claim(ev.dedupeKey()) {
+		return false, nil
+	}
+	e := ev.cloudEvent()
+
+	if s.batcher != nil {
+		// A batch that fails later loses the event, so a retry has to be let
+		// through and the balance mustn't stay debited for it. The usage is
+		// noted before queuing, so a batch failing first can't miss it.
+		key := ev.dedupeKey()
+		undo := s.cache.recordUsage(ev)
+		failed := func() {
+			undo()
+			s.dedupe.release(key)
+		}
+		if err := s.batcher.Log(ctx, e, failed); err != nil {
+			failed()
+			return false, fmt.Errorf("failed to log usage: %w", err)
+		}
+		return true, nil
+	}
+
 	resp, err := s.client.IngestEventWithResponse(ctx, e)
 
 	// Handle errors.
 	if err != nil {
+		s.dedupe.release(ev.dedupeKey())
 		return false, fmt.Errorf("failed to log usage: %w", err)
 	}
 
@@ -104,50 +127,63 @@ func (s *ImageGenService) LogUsage(ctx context.Context) (bool, error) {
 	// A non-2xx status code doesn't cause an error.
 	// See: https://pkg.go.dev/net/http#Client.Do
 	if resp.StatusCode() >= 400 {
+		s.dedupe.release(ev.dedupeKey())
 		return false, fmt.Errorf("non-2xx status code: %d", resp.StatusCode())
 	}
 
+	s.cache.recordUsage(ev)
 	return true, nil
 }
 
-func (s *ImageGenService) CheckAvailability() (bool, float64, float64, float64, error)  {
-	ctx := context.Background()
-
-	// we are only checking for GPU time, not count of outputs or count of requests
-	entitlement, err := s.client.GetEntitlementValueWithResponse(ctx, "customer123", "gputimecheck", &openmeter.GetEntitlementValueParams{})
-	if err != nil {
-		return false, 0, 0, 0, fmt.Errorf("failed to get entitlement: %w", err)
+// Close flushes usage queued by the batcher, if there is one.
+func (s *ImageGenService) Close(ctx context.Context) error {
+	if s.batcher == nil {
+		return nil
 	}
-
-	hasAccess := entitlement.JSON200.HasAccess
-	balance := entitlement.JSON200.Balance
-	// config := entitlement.JSON200.Config
-	overage := entitlement.JSON200.Overage
-	usage := entitlement.JSON200.Usage
-
-	// fmt.Println(hasAccess, balance, config, overage, usage)
-
-	return *hasAccess, *balance, *overage, *usage, nil
+	return s.batcher.Close(ctx)
 }
 
+// CheckAvailability returns the entitlement, or an *EntitlementError if
+// OpenMeter answered with something other than a value: errors.Is it against
+// ErrEntitlementNotFound, ErrUnauthorized or ErrRateLimited. With a cache it
+// is cheap enough to call on every request.
+func (s *ImageGenService) CheckAvailability() (Entitlement, error)  {
+	ctx := context.Background()
 
-// Example usage in your HTTP handler
-// func handleImageGenRequest(svc *ImageGenService) http.HandlerFunc {
-//     return func(w http.ResponseWriter, r *http.Request) {
-//         allowed, err := svc.CheckAvailability()
-//         if err != nil {
-//             http.Error(w, "Error checking usage", http.StatusInternalServerError)
-//             return
-//         }
+	// we are only checking for GPU time, not count of outputs or count of requests
+	return s.lookupEntitlement(ctx, s.subject, s.feature)
+}
 
-//         if !allowed {
-//             http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-//             return
-//         }
 
-//         // Continue with image generation...
-//     }
-// }
+// handleImageGenRequest serves image generation: generate does the work and
+// returns how many outputs it made, and the GPU time it took is logged for
+// the subject. Requests are only let through while the subject's
+// entitlement to svc's feature has access and limiters allow them.
+func handleImageGenRequest(svc *ImageGenService, generate func(ctx context.Context) (int, error), limiters ...Limiter) http.Handler {
+	cfg := RateLimitConfig{Limiters: append([]Limiter{svc.limiter(svc.feature)}, limiters...)}
+	return rateLimit(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject := rateLimitSubject(r.Context())
+		start := time.Now()
+		outputs, err := generate(r.Context())
+		if err != nil {
+			log.Printf("image generation failed for %s: %v", subject, err)
+			http.Error(w, "image generation failed", http.StatusInternalServerError)
+			return
+		}
+		gpuTime := time.Since(start).Seconds()
+
+		_, err = svc.LogUsage(r.Context(), UsageEvent{
+			Subject: subject,
+			Type:    "text2media",
+			Values:  map[string]float64{"gpu_time": gpuTime, "outputs": float64(outputs)},
+		})
+		if err != nil {
+			// The work is done either way; losing its usage is ours to fix
+			log.Printf("failed to log usage for %s: %v", subject, err)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"outputs": outputs, "gpu_time": gpuTime})
+	}))
+}
 
 func main2() {
 	if err := godotenv.Load(); err != nil {
@@ -168,7 +204,10 @@ func main2() {
     var totalLogUsageTime time.Duration
     for i := 0; i < iterations; i++ {
         start := time.Now()
-        success, err := svc.LogUsage(ctx)
+        success, err := svc.LogUsage(ctx, UsageEvent{
+            Type: "text2media",
+            Values: map[string]float64{"gpu_time": 30, "outputs": 4},
+        })
         elapsed := time.Since(start)
         totalLogUsageTime += elapsed
 
@@ -179,18 +218,19 @@ func main2() {
         time.Sleep(time.Millisecond * 100)
     }
 
-    // Test CheckAvailability
+    // Test CheckAvailability, against OpenMeter rather than the cache
     fmt.Println("\n=== Testing CheckAvailability ===")
+    svc.cache = nil
     var totalCheckTime time.Duration
     for i := 0; i < iterations; i++ {
         start := time.Now()
-        hasAccess, balance, overage, usage, err := svc.CheckAvailability()
+        entitlement, err := svc.CheckAvailability()
         elapsed := time.Since(start)
         totalCheckTime += elapsed
 
         fmt.Printf("Iteration %d: Latency: %v\n", i+1, elapsed)
         fmt.Printf("  HasAccess: %v, Balance: %.2f, Overage: %.2f, Usage: %.2f, Error: %v\n",
-            hasAccess, balance, overage, usage, err)
+            entitlement.HasAccess, entitlement.Balance, entitlement.Overage, entitlement.Usage, err)
         
         time.Sleep(time.Millisecond * 100)
     }
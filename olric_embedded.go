@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/buraksezer/olric"
+	"github.com/buraksezer/olric/config"
+)
+
+// startOlric starts an embedded single-node Olric the way main6 does, waits
+// for it to be ready and returns a DMap plus a function that shuts it down.
+func startOlric(dmapName string) (olric.DMap, func(), error) {
+	c := config.New("local")
+	c.LogLevel = "ERROR"
+	c.LogVerbosity = 1
+
+	ready := make(chan struct{})
+	c.Started = func() { close(ready) }
+
+	db, err := olric.New(c)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Olric instance: %w", err)
+	}
+	startErr := make(chan error, 1)
+	go func() { startErr <- db.Start() }()
+
+	select {
+	case <-ready:
+	case err := <-startErr:
+		return nil, nil, fmt.Errorf("olric.Start returned an error: %w", err)
+	case <-time.After(30 * time.Second):
+		return nil, nil, fmt.Errorf("olric did not start within 30s")
+	}
+
+	shutdown := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := db.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shutdown Olric: %v", err)
+		}
+	}
+	dm, err := db.NewEmbeddedClient().NewDMap(dmapName)
+	if err != nil {
+		shutdown()
+		return nil, nil, fmt.Errorf("failed to create DMap: %w", err)
+	}
+	return dm, shutdown, nil
+}
@@ -12,7 +12,7 @@ import (
 	"github.com/buraksezer/olric/config"
 )
 
-func updateLimiterState5(ctx context.Context, dm olric.DMap, userID string, endpointID string, tokens int64) error {
+func updateLimiterState5(ctx context.Context, dm olric.DMap, userID string, endpointID string, tokens int64) (Decision, error) {
     slidingKey := fmt.Sprintf("ratelimit:sliding:%s:%s", userID, endpointID)
     fixedKey := fmt.Sprintf("ratelimit:fixed:%s:%s", userID, endpointID)
     maxRetries := 5
@@ -25,7 +25,7 @@ func updateLimiterState5(ctx context.Context, dm olric.DMap, userID string, endp
                 time.Sleep(time.Millisecond * 10)
                 continue
             }
-            return fmt.Errorf("failed to get sliding window count: %w", err)
+            return Decision{}, fmt.Errorf("failed to get sliding window count: %w", err)
         }
         
         fixedVal, err := dm.Get(ctx, fixedKey)
@@ -34,7 +34,7 @@ func updateLimiterState5(ctx context.Context, dm olric.DMap, userID string, endp
                 time.Sleep(time.Millisecond * 10)
                 continue
             }
-            return fmt.Errorf("failed to get fixed window count: %w", err)
+            return Decision{}, fmt.Errorf("failed to get fixed window count: %w", err)
         }
 
         // Get current counts, defaulting to 0 if not found
@@ -50,31 +50,32 @@ func updateLimiterState5(ctx context.Context, dm olric.DMap, userID string, endp
 
         // Check if adding tokens would exceed limits
         if slidingCount + tokens > 500 || fixedCount + tokens > 500 {
-            return fmt.Errorf("rate limit exceeded: sliding=%d, fixed=%d, limit=500", slidingCount, fixedCount)
+            return counterDecision(false, 500, []int64{slidingCount, fixedCount}, nil), nil
         }
 
         // If we're here, we can increment both counters
-        _, err = dm.Incr(ctx, slidingKey, int(tokens))
+        slidingNew, err := dm.Incr(ctx, slidingKey, int(tokens))
         if err != nil {
             if err == olric.ErrWriteQuorum {
                 time.Sleep(time.Millisecond * 10)
                 continue
             }
-            return fmt.Errorf("failed to increment sliding window: %w", err)
+            return Decision{}, fmt.Errorf("failed to increment sliding window: %w", err)
         }
 
-        _, err = dm.Incr(ctx, fixedKey, int(tokens))
+        fixedNew, err := dm.Incr(ctx, fixedKey, int(tokens))
         if err != nil {
             if err == olric.ErrWriteQuorum {
                 time.Sleep(time.Millisecond * 10)
                 continue
             }
-            return fmt.Errorf("failed to increment fixed window: %w", err)
+            return Decision{}, fmt.Errorf("failed to increment fixed window: %w", err)
         }
 
-        return nil
+        // The counters have no TTL, so the windows never reset
+        return counterDecision(true, 500, []int64{int64(slidingNew), int64(fixedNew)}, nil), nil
     }
-    return fmt.Errorf("failed to update after %d retries", maxRetries)
+    return Decision{}, fmt.Errorf("failed to update after %d retries", maxRetries)
 }
 
 func main5() {
@@ -143,11 +144,15 @@ func main5() {
             for j := 0; j < updatesPerRoutine; j++ {
                 start := time.Now()
                 
-                err := updateLimiterState5(context.Background(), dm, userID, endpointID, 1)
+                d, err := updateLimiterState5(context.Background(), dm, userID, endpointID, 1)
                 if err != nil {
                     log.Printf("Error in routine %d: %v", routineID, err)
                     continue
                 }
+                if !d.Allowed {
+                    log.Printf("Rate limited in routine %d: %d/%d left", routineID, d.Remaining, d.Limit)
+                    continue
+                }
                 
                 latencyChan <- time.Since(start)
 
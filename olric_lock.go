@@ -18,11 +18,11 @@ const (
 	lockTimeout   = 1 * time.Second
 )
 
-func incrementWithLock(ctx context.Context, dm olric.DMap, key string, amount int64, routineID int) error {
+func incrementWithLock(ctx context.Context, dm olric.DMap, key string, amount int64, routineID int) (Decision, error) {
 	// Try to acquire lock
 	token, err := dm.LockWithTimeout(ctx, key, 1 * time.Second, lockTimeout)
 	if err != nil {
-		return fmt.Errorf("failed to acquire lock: %w", err)
+		return Decision{}, fmt.Errorf("failed to acquire lock: %w", err)
 	}
 	
 	// Ensure we release the lock
@@ -35,7 +35,7 @@ func incrementWithLock(ctx context.Context, dm olric.DMap, key string, amount in
 	// Read current value
 	val, err := dm.Get(ctx, key)
 	if err != nil && err != olric.ErrKeyNotFound {
-		return fmt.Errorf("failed to get value: %w", err)
+		return Decision{}, fmt.Errorf("failed to get value: %w", err)
 	}
 
 	// Get current count, defaulting to 0 if not found
@@ -43,22 +43,22 @@ func incrementWithLock(ctx context.Context, dm olric.DMap, key string, amount in
 	if val != nil {
 		currentCount, err = val.Int64()
 		if err != nil {
-			return fmt.Errorf("failed to parse value: %w", err)
+			return Decision{}, fmt.Errorf("failed to parse value: %w", err)
 		}
 	}
 
 	// Check if adding amount would exceed limit
 	if currentCount+amount > limit {
-		return fmt.Errorf("would exceed limit of %d", limit)
+		return counterDecision(false, limit, []int64{currentCount}, nil), nil
 	}
 
 	// Increment the value
 	err = dm.Put(ctx, key, currentCount+amount)
 	if err != nil {
-		return fmt.Errorf("failed to put new value: %w", err)
+		return Decision{}, fmt.Errorf("failed to put new value: %w", err)
 	}
 
-	return nil
+	return counterDecision(true, limit, []int64{currentCount + amount}, nil), nil
 }
 
 func main6() {
@@ -114,11 +114,15 @@ func main6() {
 			defer wg.Done()
 			
 			for j := 0; j < updatesPerRoutine; j++ {
-				err := incrementWithLock(ctx, dm, key, 1, routineID)
+				d, err := incrementWithLock(ctx, dm, key, 1, routineID)
 				if err != nil {
 					log.Printf("Routine %d update %d failed: %v", routineID, j, err)
 					continue
 				}
+				if !d.Allowed {
+					log.Printf("Routine %d update %d would exceed limit of %d", routineID, j, d.Limit)
+					continue
+				}
 			}
 		}(i)
 	}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+)
+
+const defaultOpenMeterURL = "https://openmeter.cloud"
+
+// OpenMeterConfig is how the service reaches OpenMeter. The zero value of
+// each field means its default.
+type OpenMeterConfig struct {
+	// BaseURL defaults to OpenMeter Cloud; set it for a self-hosted OpenMeter
+	BaseURL string
+	APIKey  string
+
+	// Timeout bounds each call, retries included. Defaults to 10s.
+	Timeout time.Duration
+	// MaxRetries is how many times a call is retried after a 429, a 5xx or a
+	// transport error; negative turns retries off. Defaults to 3. Only calls
+	// that are safe to repeat are retried (see retryTransport).
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubled each time,
+	// unless the server sends a longer Retry-After. Defaults to 100ms.
+	RetryBackoff time.Duration
+	// MaxRetryWait caps any single wait, Retry-After included. Defaults to 5s.
+	MaxRetryWait time.Duration
+
+	// MaxIdleConnsPerHost is how many connections to OpenMeter are kept open
+	// between calls. net/http keeps 2, so anything busier than that opens a
+	// new TLS connection per call. Defaults to 64.
+	MaxIdleConnsPerHost int
+	// HTTPClient replaces the client built from the settings above, except
+	// that retries are still added around its transport.
+	HTTPClient *http.Client
+
+	// Headers are added to every request
+	Headers http.Header
+	// RequestEditors run on every request after the built-in ones, for
+	// anything else a request needs, such as injecting a tracer's context
+	RequestEditors []openmeter.RequestEditorFn
+}
+
+// openMeterConfigFromEnv reads OPENMETER_URL and TOKEN.
+func openMeterConfigFromEnv() OpenMeterConfig {
+	return OpenMeterConfig{BaseURL: os.Getenv("OPENMETER_URL"), APIKey: os.Getenv("TOKEN")}
+}
+
+// newOpenMeterClient builds a client from cfg.
+func newOpenMeterClient(cfg OpenMeterConfig) (*openmeter.ClientWithResponses, error) {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = defaultOpenMeterURL
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxRetryWait == 0 {
+		cfg.MaxRetryWait = 5 * time.Second
+	}
+	if cfg.MaxIdleConnsPerHost == 0 {
+		cfg.MaxIdleConnsPerHost = 64
+	}
+
+	var client http.Client
+	if cfg.HTTPClient != nil {
+		client = *cfg.HTTPClient
+	} else {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConns = max(transport.MaxIdleConns, cfg.MaxIdleConnsPerHost)
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+		client = http.Client{Transport: transport, Timeout: cfg.Timeout}
+	}
+	if cfg.MaxRetries > 0 {
+		base := client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		client.Transport = &retryTransport{
+			base:       base,
+			maxRetries: cfg.MaxRetries,
+			backoff:    cfg.RetryBackoff,
+			maxWait:    cfg.MaxRetryWait,
+		}
+	}
+
+	opts := []openmeter.ClientOption{
+		openmeter.WithHTTPClient(&client),
+		openmeter.WithRequestEditorFn(func(ctx context.Context, req *http.Request) error {
+			for name, values := range cfg.Headers {
+				for _, v := range values {
+					req.Header.Add(name, v)
+				}
+			}
+			return nil
+		}),
+		openmeter.WithRequestEditorFn(injectTraceParent),
+	}
+	for _, fn := range cfg.RequestEditors {
+		opts = append(opts, openmeter.WithRequestEditorFn(fn))
+	}
+	c, err := openmeter.NewAuthClientWithResponses(cfg.BaseURL, cfg.APIKey, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	return c, nil
+}
+
+type traceParentKey struct{}
+
+// withTraceParent carries a W3C traceparent for calls made with ctx, so
+// OpenMeter's side of a request shows up in the caller's trace.
+func withTraceParent(ctx context.Context, traceparent string) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, traceparent)
+}
+
+func injectTraceParent(ctx context.Context, req *http.Request) error {
+	if tp, ok := ctx.Value(traceParentKey{}).(string); ok && tp != "" {
+		req.Header.Set("traceparent", tp)
+	}
+	return nil
+}
+
+type retryKey struct{}
+
+// withRetries marks calls made with ctx as safe to retry, for a call that
+// isn't idempotent by its method but is in practice.
+func withRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryKey{}, true)
+}
+
+// retryTransport retries requests that got a 429, a 5xx or no answer at
+// all, with exponential backoff, or after Retry-After if the server says to
+// wait longer. Only idempotent methods, ingest and calls made withRetries
+// are retried: a POST that timed out may have been applied, and sending it
+// again would create a second feature or grant. Ingest is safe to retry
+// because events are deduplicated on (source, id). Requests whose body can't
+// be replayed aren't retried either.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	backoff    time.Duration
+	maxWait    time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		resp, err := t.base.RoundTrip(req)
+
+		retryable := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if !retryable || !safeToRetry(req) || attempt >= t.maxRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if err != nil && req.Context().Err() != nil {
+			return resp, err
+		}
+
+		wait := t.backoff << attempt
+		if resp != nil {
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = max(wait, time.Duration(secs)*time.Second)
+			}
+			// Drain so the connection goes back to the pool
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		wait = min(wait, t.maxWait)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// safeToRetry reports whether sending req twice has the same effect as
+// sending it once.
+func safeToRetry(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		if strings.HasSuffix(req.URL.Path, "/api/v1/events") {
+			return true
+		}
+	}
+	retry, _ := req.Context().Value(retryKey{}).(bool)
+	return retry
+}
+
+// main29 points the service at the simulator through OpenMeterConfig and
+// shows each setting at work: retries through 503s and a 429 with
+// Retry-After but none for creating a feature, a header and a traceparent
+// arriving at the server, a timeout, and how many connections 200
+// concurrent checks open with net/http's default pool and with ours.
+func main29() {
+	ctx := context.Background()
+	om := startStandinOpenMeter()
+	defer om.Close()
+	yes := true
+	om.setEntitlement("customer123", "gputimecheck", openmeter.EntitlementValue{HasAccess: &yes})
+
+	cfg := OpenMeterConfig{
+		BaseURL:      om.URL(),
+		APIKey:       "test-token",
+		RetryBackoff: 20 * time.Millisecond,
+		Headers:      http.Header{"X-Service": {"image-gen"}},
+	}
+	svc, err := NewImageGenServiceWithConfig(cfg)
+	if err != nil {
+		log.Fatalf("failed to create service: %v", err)
+	}
+	ev := UsageEvent{Type: "text2media", Values: map[string]float64{"gpu_time": 30, "outputs": 4}}
+
+	fmt.Println("=== Retries ===")
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		om.failNext(2, status)
+		_, _, before := om.stats()
+		start := time.Now()
+		ok, err := svc.LogUsage(ctx, ev)
+		_, _, after := om.stats()
+		fmt.Printf("Two %ds: logged=%v err=%v after %d requests in %v\n",
+			status, ok, err, after-before, time.Since(start).Round(10*time.Millisecond))
+	}
+	// Creating a feature isn't idempotent, so a 503 is returned as it is
+	om.failNext(1, http.StatusServiceUnavailable)
+	_, _, before := om.stats()
+	resp, err := svc.client.CreateFeatureWithResponse(ctx, openmeter.CreateFeatureJSONRequestBody{Key: "retry_demo", Name: "retry_demo"})
+	_, _, after := om.stats()
+	if err != nil {
+		log.Fatalf("failed to create feature: %v", err)
+	}
+	fmt.Printf("One 503 creating a feature: status=%d after %d requests\n", resp.StatusCode(), after-before)
+
+	fmt.Println("\n=== Headers ===")
+	traced := withTraceParent(ctx, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, err := svc.LogUsage(traced, ev); err != nil {
+		log.Printf("Error: %v", err)
+	}
+	h := om.lastHeaders()
+	fmt.Printf("Authorization: %s\nX-Service: %s\ntraceparent: %s\n",
+		h.Get("Authorization"), h.Get("X-Service"), h.Get("traceparent"))
+
+	fmt.Println("\n=== Timeout ===")
+	om.setLatency(300 * time.Millisecond)
+	slow := cfg
+	slow.Timeout = 100 * time.Millisecond
+	slow.MaxRetries = -1
+	slowSvc, err := NewImageGenServiceWithConfig(slow)
+	if err != nil {
+		log.Fatalf("failed to create service: %v", err)
+	}
+	slowSvc.cache = nil
+	start := time.Now()
+	_, err = slowSvc.CheckAvailability()
+	var netErr net.Error
+	fmt.Printf("Gave up after %v, timeout=%v: %v\n",
+		time.Since(start).Round(10*time.Millisecond), errors.As(err, &netErr) && netErr.Timeout(), err)
+
+	fmt.Println("\n=== Connection pooling ===")
+	om.setLatency(10 * time.Millisecond)
+	for _, pool := range []int{2, 64} {
+		pooled := cfg
+		pooled.MaxIdleConnsPerHost = pool
+		pooledSvc, err := NewImageGenServiceWithConfig(pooled)
+		if err != nil {
+			log.Fatalf("failed to create service: %v", err)
+		}
+		pooledSvc.cache = nil
+		before := om.connections.Load()
+		for round := 0; round < 5; round++ {
+			var wg sync.WaitGroup
+			for i := 0; i < 40; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := pooledSvc.CheckAvailability(); err != nil {
+						log.Printf("Error: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+		}
+		fmt.Printf("%2d idle connections per host: %d connections opened for 200 checks\n",
+			pool, om.connections.Load()-before)
+	}
+}
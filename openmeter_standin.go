@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2/event"
+	"github.com/google/uuid"
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+)
+
+// standinOpenMeter is an in-process OpenMeter: event ingest, meter queries,
+// entitlement values, and creating meters, features and entitlements. It
+// keeps every event it accepts, deduplicated on (source, id) as OpenMeter
+// does, and computes meter values and metered entitlement balances from
+// them. Events only count once ingestLag has passed since they were
+// ingested, which is how OpenMeter's Kafka pipeline looks from outside.
+// Responses can be slowed down, failed, or answered from setEntitlement.
+type standinOpenMeter struct {
+	server *httptest.Server
+
+	// down makes every endpoint answer 503, latency delays every response
+	// and queryLatency meter queries and entitlement values on top of that.
+	down         atomic.Bool
+	latency      atomic.Int64
+	queryLatency atomic.Int64
+	ingestLag    atomic.Int64
+	ingestJitter atomic.Int64
+	// now is the simulator's clock; see useClock
+	now func() time.Time
+	// failing and failStatus make the next requests fail; see failNext
+	failing    atomic.Int64
+	failStatus atomic.Int64
+	// connections counts connections clients opened
+	connections atomic.Int64
+
+	mu         sync.Mutex
+	events     map[string]cloudevents.Event
+	ingestedAt map[string]time.Time
+	duplicates int
+	requests   int
+	headers    http.Header
+
+	// entitlements are keyed by subject/feature, as are the error statuses
+	// that replace them
+	entitlements       map[string]openmeter.EntitlementValue
+	entitlementFailure map[string]int
+	// usagePeriods are the current usage periods of entitlements given by
+	// setEntitlement, which has none to work them out from
+	usagePeriods map[string]openmeter.Period
+
+	// What provisioning creates: meters, features by key (archived ones are
+	// dropped) and each subject's entitlements
+	meters              []openmeter.Meter
+	features            map[string]provisionedFeature
+	subjectEntitlements map[string][]provisionedEntitlement
+	entitlementCreated  map[string]time.Time
+}
+
+func startStandinOpenMeter() *standinOpenMeter {
+	s := &standinOpenMeter{
+		now:                time.Now,
+		events:             make(map[string]cloudevents.Event),
+		ingestedAt:         make(map[string]time.Time),
+		entitlements:       make(map[string]openmeter.EntitlementValue),
+		entitlementFailure: make(map[string]int),
+		usagePeriods:       make(map[string]openmeter.Period),
+
+		features:            make(map[string]provisionedFeature),
+		subjectEntitlements: make(map[string][]provisionedEntitlement),
+		entitlementCreated:  make(map[string]time.Time),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/events", s.ingest)
+	mux.HandleFunc("GET /api/v1/subjects/{subject}/entitlements/{feature}/value", s.entitlementValue)
+	mux.HandleFunc("GET /api/v1/meters", s.listMeters)
+	mux.HandleFunc("GET /api/v1/meters/{meter}/query", s.queryMeter)
+	mux.HandleFunc("POST /api/v1/meters", s.createMeter)
+	mux.HandleFunc("GET /api/v1/features", s.listFeatures)
+	mux.HandleFunc("POST /api/v1/features", s.createFeature)
+	mux.HandleFunc("DELETE /api/v1/features/{id}", s.archiveFeature)
+	mux.HandleFunc("GET /api/v1/entitlements", s.listEntitlements)
+	mux.HandleFunc("POST /api/v1/subjects/{subject}/entitlements", s.createEntitlement)
+	mux.HandleFunc("DELETE /api/v1/subjects/{subject}/entitlements/{id}", s.deleteEntitlement)
+	s.server = httptest.NewUnstartedServer(s.intercept(mux))
+	s.server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.connections.Add(1)
+		}
+	}
+	s.server.Start()
+	return s
+}
+
+// intercept records each request's headers and fails it if failNext said to.
+func (s *standinOpenMeter) intercept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.headers = r.Header.Clone()
+		s.mu.Unlock()
+		if s.failing.Add(-1) >= 0 {
+			s.mu.Lock()
+			s.requests++
+			s.mu.Unlock()
+			status := int(s.failStatus.Load())
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			writeProblem(w, status, "stand-in failure")
+			return
+		}
+		s.failing.Store(0)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// failNext makes the next n requests, whatever they are, answer status. 429s
+// come with a Retry-After of a second.
+func (s *standinOpenMeter) failNext(n int, status int) {
+	s.failStatus.Store(int64(status))
+	s.failing.Store(int64(n))
+}
+
+// lastHeaders returns the headers of the last request.
+func (s *standinOpenMeter) lastHeaders() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.headers
+}
+
+func (s *standinOpenMeter) URL() string { return s.server.URL }
+
+func (s *standinOpenMeter) Close() { s.server.Close() }
+
+func (s *standinOpenMeter) setLatency(d time.Duration) { s.latency.Store(int64(d)) }
+
+// setEntitlement makes subject's entitlement value for feature v, whatever
+// the events say.
+func (s *standinOpenMeter) setEntitlement(subject string, feature string, v openmeter.EntitlementValue) {
+	s.mu.Lock()
+	s.entitlements[subject+"/"+feature] = v
+	s.mu.Unlock()
+}
+
+// setUsagePeriod makes the current usage period of subject's entitlement to
+// feature, as listed, p.
+func (s *standinOpenMeter) setUsagePeriod(subject string, feature string, p openmeter.Period) {
+	s.mu.Lock()
+	s.usagePeriods[subject+"/"+feature] = p
+	s.mu.Unlock()
+}
+
+// failEntitlement makes reads of subject's entitlement for feature answer
+// with status instead, as a problem response. 429s come with Retry-After.
+func (s *standinOpenMeter) failEntitlement(subject string, feature string, status int) {
+	s.mu.Lock()
+	s.entitlementFailure[subject+"/"+feature] = status
+	s.mu.Unlock()
+}
+
+// writeProblem answers with an RFC 7807 problem, as OpenMeter does.
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type":   "about:blank",
+		"title":  http.StatusText(status),
+		"status": status,
+		"detail": detail,
+	})
+}
+
+// delay waits out the configured latency, plus extra, or until the client
+// gives up.
+func (s *standinOpenMeter) delay(r *http.Request, extra time.Duration) {
+	select {
+	case <-time.After(time.Duration(s.latency.Load()) + extra):
+	case <-r.Context().Done():
+	}
+}
+
+func (s *standinOpenMeter) ingest(w http.ResponseWriter, r *http.Request) {
+	s.delay(r, 0)
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+	if s.down.Load() {
+		http.Error(w, "ingest unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var events []cloudevents.Event
+	dec := json.NewDecoder(r.Body)
+	switch ct := r.Header.Get("Content-Type"); {
+	case strings.HasPrefix(ct, "application/cloudevents-batch+json"):
+		if err := dec.Decode(&events); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case strings.HasPrefix(ct, "application/cloudevents+json"):
+		var e cloudevents.Event
+		if err := dec.Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events = append(events, e)
+	default:
+		http.Error(w, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+	for _, e := range events {
+		if err := e.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	now := s.now()
+	for _, e := range events {
+		key := e.Source() + "/" + e.ID()
+		if _, ok := s.events[key]; ok {
+			s.duplicates++
+			continue
+		}
+		s.events[key] = e
+		// Jitter counts as ingesting the event that much later
+		s.ingestedAt[key] = now
+		if jitter := s.ingestJitter.Load(); jitter > 0 {
+			s.ingestedAt[key] = now.Add(time.Duration(rand.Int64N(jitter)))
+		}
+	}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *standinOpenMeter) entitlementValue(w http.ResponseWriter, r *http.Request) {
+	s.delay(r, time.Duration(s.queryLatency.Load()))
+	s.mu.Lock()
+	s.requests++
+	key := r.PathValue("subject") + "/" + r.PathValue("feature")
+	v, ok := s.entitlements[key]
+	if !ok {
+		v, ok = s.computeEntitlementLocked(r.PathValue("subject"), r.PathValue("feature"))
+	}
+	failure := s.entitlementFailure[key]
+	s.mu.Unlock()
+	if s.down.Load() {
+		writeProblem(w, http.StatusServiceUnavailable, "entitlements unavailable")
+		return
+	}
+	if failure != 0 {
+		if failure == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "2")
+		}
+		writeProblem(w, failure, "stand-in failure")
+		return
+	}
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "no entitlement for "+key)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// stats returns the number of distinct events, duplicates dropped and
+// requests served so far.
+func (s *standinOpenMeter) stats() (events int, duplicates int, requests int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.events), s.duplicates, s.requests
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *standinOpenMeter) listMeters(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	writeJSON(w, http.StatusOK, append([]openmeter.Meter{}, s.meters...))
+}
+
+func (s *standinOpenMeter) createMeter(w http.ResponseWriter, r *http.Request) {
+	var m openmeter.Meter
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	for _, have := range s.meters {
+		if have.Slug == m.Slug {
+			writeProblem(w, http.StatusConflict, "meter "+m.Slug+" already exists")
+			return
+		}
+	}
+	m.ID = uuid.NewString()
+	s.meters = append(s.meters, m)
+	writeJSON(w, http.StatusCreated, m)
+}
+
+func (s *standinOpenMeter) listFeatures(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	features := make([]provisionedFeature, 0, len(s.features))
+	for _, key := range slices.Sorted(maps.Keys(s.features)) {
+		features = append(features, s.features[key])
+	}
+	writeList(w, r, features)
+}
+
+// writeList answers a list request with items, as a page of them if the
+// request asks for one and as a plain list otherwise, like OpenMeter.
+func writeList[T any](w http.ResponseWriter, r *http.Request, items []T) {
+	q := r.URL.Query()
+	if !q.Has("page") {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page < 1 {
+		writeProblem(w, http.StatusBadRequest, "bad page "+q.Get("page"))
+		return
+	}
+	pageSize := 100
+	if q.Has("pageSize") {
+		if pageSize, err = strconv.Atoi(q.Get("pageSize")); err != nil || pageSize < 1 {
+			writeProblem(w, http.StatusBadRequest, "bad pageSize "+q.Get("pageSize"))
+			return
+		}
+	}
+	start := min((page-1)*pageSize, len(items))
+	end := min(start+pageSize, len(items))
+	writeJSON(w, http.StatusOK, map[string]any{
+		"items":      items[start:end],
+		"page":       page,
+		"pageSize":   pageSize,
+		"totalCount": len(items),
+	})
+}
+
+func (s *standinOpenMeter) createFeature(w http.ResponseWriter, r *http.Request) {
+	var f provisionedFeature
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if _, ok := s.features[f.Key]; ok {
+		writeProblem(w, http.StatusConflict, "feature "+f.Key+" already exists")
+		return
+	}
+	f.ID = uuid.NewString()
+	s.features[f.Key] = f
+	writeJSON(w, http.StatusCreated, f)
+}
+
+func (s *standinOpenMeter) archiveFeature(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	for key, f := range s.features {
+		if f.ID == r.PathValue("id") {
+			delete(s.features, key)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeProblem(w, http.StatusNotFound, "no feature "+r.PathValue("id"))
+}
+
+func (s *standinOpenMeter) listEntitlements(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	subjects := r.URL.Query()["subject"]
+	if len(subjects) == 0 {
+		subjects = slices.Sorted(maps.Keys(s.subjectEntitlements))
+	}
+	features := r.URL.Query()["feature"]
+	ents := []listedEntitlement{}
+	for _, subject := range subjects {
+		provisioned := len(ents)
+		for _, e := range s.subjectEntitlements[subject] {
+			if len(features) > 0 && !slices.Contains(features, e.FeatureKey) {
+				continue
+			}
+			listed := listedEntitlement{provisionedEntitlement: e}
+			if p, ok := s.usagePeriods[subject+"/"+e.FeatureKey]; ok {
+				listed.CurrentUsagePeriod = &p
+			} else if e.UsagePeriod != nil {
+				if next := periodStep(e.UsagePeriod.Interval); next != nil {
+					from := periodStart(s.entitlementCreated[e.ID], e.UsagePeriod.Interval, s.now())
+					listed.CurrentUsagePeriod = &openmeter.Period{From: from, To: next(from)}
+				}
+			}
+			ents = append(ents, listed)
+		}
+		// Entitlements only given by setEntitlement
+		for _, feature := range features {
+			p, ok := s.usagePeriods[subject+"/"+feature]
+			if ok && !slices.ContainsFunc(ents[provisioned:], func(e listedEntitlement) bool { return e.FeatureKey == feature }) {
+				ents = append(ents, listedEntitlement{
+					provisionedEntitlement: provisionedEntitlement{Type: "metered", FeatureKey: feature},
+					CurrentUsagePeriod:     &p,
+				})
+			}
+		}
+	}
+	writeList(w, r, ents)
+}
+
+// listedEntitlement is an entitlement as listed, with its current usage
+// period if it's metered.
+type listedEntitlement struct {
+	provisionedEntitlement
+	CurrentUsagePeriod *openmeter.Period `json:"currentUsagePeriod,omitempty"`
+}
+
+func (s *standinOpenMeter) createEntitlement(w http.ResponseWriter, r *http.Request) {
+	var e provisionedEntitlement
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	subject := r.PathValue("subject")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if _, ok := s.features[e.FeatureKey]; !ok {
+		writeProblem(w, http.StatusNotFound, "no feature "+e.FeatureKey)
+		return
+	}
+	for _, have := range s.subjectEntitlements[subject] {
+		if have.FeatureKey == e.FeatureKey {
+			writeProblem(w, http.StatusConflict, "entitlement already exists for "+subject+"/"+e.FeatureKey)
+			return
+		}
+	}
+	e.ID = uuid.NewString()
+	s.entitlementCreated[e.ID] = s.now()
+	// Returned as a string, the way OpenMeter does
+	if e.Config != nil {
+		e.Config, _ = json.Marshal(string(e.Config))
+	}
+	s.subjectEntitlements[subject] = append(s.subjectEntitlements[subject], e)
+	writeJSON(w, http.StatusCreated, e)
+}
+
+func (s *standinOpenMeter) deleteEntitlement(w http.ResponseWriter, r *http.Request) {
+	subject := r.PathValue("subject")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	ents := s.subjectEntitlements[subject]
+	for i, e := range ents {
+		if e.ID == r.PathValue("id") {
+			s.subjectEntitlements[subject] = append(ents[:i:i], ents[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeProblem(w, http.StatusNotFound, "no entitlement "+r.PathValue("id"))
+}
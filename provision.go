@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+	"github.com/openmeterio/openmeter/pkg/models"
+)
+
+// ProvisioningSpec is everything OpenMeter needs to gate our endpoints: the
+// meters (counters), a feature per meter, the plans that put limits on those
+// features, and which plan each subject (customer) is on. Provisioning turns
+// it into OpenMeter's meters, features and per-subject entitlements, so plans
+// stay in one place rather than being clicked together customer by customer.
+type ProvisioningSpec struct {
+	Meters   []MeterSpec       `json:"meters"`
+	Features []FeatureSpec     `json:"features"`
+	Plans    []UsagePlan       `json:"plans"`
+	Subjects map[string]string `json:"subjects"` // subject -> plan name
+}
+
+type MeterSpec struct {
+	Slug          string                  `json:"slug"`
+	EventType     string                  `json:"eventType"`
+	Aggregation   models.MeterAggregation `json:"aggregation"`
+	ValueProperty string                  `json:"valueProperty,omitempty"`
+	GroupBy       map[string]string       `json:"groupBy,omitempty"`
+	WindowSize    models.WindowSize       `json:"windowSize,omitempty"`
+}
+
+type FeatureSpec struct {
+	Key            string            `json:"key"`
+	Name           string            `json:"name"`
+	MeterSlug      string            `json:"meterSlug,omitempty"`
+	GroupByFilters map[string]string `json:"groupByFilters,omitempty"`
+}
+
+// UsagePlan is what OpenMeter lacks a notion of: a set of limits shared by
+// every subject on it.
+type UsagePlan struct {
+	Name         string            `json:"name"`
+	Entitlements []PlanEntitlement `json:"entitlements"`
+}
+
+// PlanEntitlement is one feature's limit in a plan. Type is "metered",
+// "boolean" or "static". A metered entitlement grants Limit every Period
+// (DAY, WEEK, MONTH, YEAR or an ISO 8601 duration); a static one carries
+// Config, a JSON object.
+type PlanEntitlement struct {
+	Feature   string          `json:"feature"`
+	Type      string          `json:"type"`
+	Limit     float64         `json:"limit,omitempty"`
+	Period    string          `json:"period,omitempty"`
+	SoftLimit bool            `json:"softLimit,omitempty"`
+	Config    json.RawMessage `json:"config,omitempty"`
+}
+
+// defaultProvisioningSpec is the setup main.go's comments describe: three
+// counters on the same event type, a feature for each, and plans limiting all
+// three.
+var defaultProvisioningSpec = ProvisioningSpec{
+	Meters: []MeterSpec{
+		{Slug: "requests", EventType: "text2media", Aggregation: models.MeterAggregationCount, WindowSize: models.WindowSizeMinute},
+		{Slug: "gpu_time", EventType: "text2media", Aggregation: models.MeterAggregationSum, ValueProperty: "$.gpu_time", WindowSize: models.WindowSizeMinute},
+		{Slug: "outputs", EventType: "text2media", Aggregation: models.MeterAggregationSum, ValueProperty: "$.outputs", WindowSize: models.WindowSizeMinute},
+	},
+	Features: []FeatureSpec{
+		{Key: "requests-per-day", Name: "Requests per day", MeterSlug: "requests"},
+		{Key: "gputimecheck", Name: "GPU seconds per day", MeterSlug: "gpu_time"},
+		{Key: "outputs-per-month", Name: "Outputs per month", MeterSlug: "outputs"},
+	},
+	Plans: []UsagePlan{
+		{Name: "free", Entitlements: []PlanEntitlement{
+			{Feature: "requests-per-day", Type: "metered", Limit: 100, Period: "DAY"},
+			{Feature: "gputimecheck", Type: "metered", Limit: 600, Period: "DAY"},
+			{Feature: "outputs-per-month", Type: "metered", Limit: 1000, Period: "MONTH"},
+		}},
+		{Name: "pro", Entitlements: []PlanEntitlement{
+			{Feature: "requests-per-day", Type: "metered", Limit: 5000, Period: "DAY", SoftLimit: true},
+			{Feature: "gputimecheck", Type: "metered", Limit: 36000, Period: "DAY"},
+			{Feature: "outputs-per-month", Type: "metered", Limit: 100000, Period: "MONTH"},
+		}},
+	},
+	Subjects: map[string]string{"customer123": "free"},
+}
+
+func loadProvisioningSpec(path string) (ProvisioningSpec, error) {
+	var spec ProvisioningSpec
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return spec, fmt.Errorf("failed to read plans: %w", err)
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return spec, fmt.Errorf("failed to parse plans: %w", err)
+	}
+	for _, plan := range spec.Plans {
+		for _, pe := range plan.Entitlements {
+			if pe.Type == "metered" && pe.Period == "" {
+				return spec, fmt.Errorf("plan %s: metered entitlement to %s has no period", plan.Name, pe.Feature)
+			}
+		}
+	}
+	return spec, nil
+}
+
+// provisionChange is one step of bringing OpenMeter in line with a spec.
+// Conflicts have no apply: they are differences provisioning won't make.
+type provisionChange struct {
+	op     byte // '+' create, '~' replace, '-' delete, '!' conflict
+	kind   string
+	name   string
+	detail string
+	apply  func(ctx context.Context) error
+}
+
+func (c provisionChange) String() string {
+	s := fmt.Sprintf("%c %s %s", c.op, c.kind, c.name)
+	if c.detail != "" {
+		s += ": " + c.detail
+	}
+	return s
+}
+
+// openMeterError turns a non-2xx answer into an error.
+func openMeterError(what string, status int, body []byte) error {
+	var problem struct {
+		Detail string `json:"detail"`
+	}
+	json.Unmarshal(body, &problem)
+	if problem.Detail != "" {
+		return fmt.Errorf("failed to %s: non-2xx status code: %d: %s", what, status, problem.Detail)
+	}
+	return fmt.Errorf("failed to %s: non-2xx status code: %d", what, status)
+}
+
+// provisionedFeature and provisionedEntitlement are the parts of OpenMeter's
+// features and entitlements that provisioning compares. They are decoded by
+// hand because the client models both list responses as unions.
+type provisionedFeature struct {
+	ID                  string            `json:"id"`
+	Key                 string            `json:"key"`
+	Name                string            `json:"name"`
+	MeterSlug           string            `json:"meterSlug,omitempty"`
+	MeterGroupByFilters map[string]string `json:"meterGroupByFilters,omitempty"`
+}
+
+type provisionedEntitlement struct {
+	ID              string          `json:"id,omitempty"`
+	Type            string          `json:"type"`
+	FeatureKey      string          `json:"featureKey"`
+	IssueAfterReset *float64        `json:"issueAfterReset,omitempty"`
+	IsSoftLimit     *bool           `json:"isSoftLimit,omitempty"`
+	UsagePeriod     *usagePeriod    `json:"usagePeriod,omitempty"`
+	Config          json.RawMessage `json:"config,omitempty"`
+}
+
+type usagePeriod struct {
+	Interval string `json:"interval"`
+}
+
+// provisionPageSize is how many features or entitlements a list request asks
+// for at a time.
+const provisionPageSize = 100
+
+// listAll collects every item of a list endpoint, asking for page after page
+// until it has totalCount of them. fetch requests one page. A plain list
+// means the server didn't paginate and is all there is.
+func listAll[T any](what string, fetch func(page int) (int, []byte, error)) ([]T, error) {
+	var all []T
+	for page := 1; ; page++ {
+		status, body, err := fetch(page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", what, err)
+		}
+		if status != http.StatusOK {
+			return nil, openMeterError("list "+what, status, body)
+		}
+		var items []T
+		if err := json.Unmarshal(body, &items); err == nil {
+			return append(all, items...), nil
+		}
+		var p struct {
+			Items      []T `json:"items"`
+			TotalCount int `json:"totalCount"`
+		}
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", what, err)
+		}
+		all = append(all, p.Items...)
+		if len(p.Items) == 0 || len(all) >= p.TotalCount {
+			return all, nil
+		}
+	}
+}
+
+func listFeatures(ctx context.Context, client *openmeter.ClientWithResponses) (map[string]provisionedFeature, error) {
+	features, err := listAll[provisionedFeature]("features", func(page int) (int, []byte, error) {
+		pageSize := provisionPageSize
+		resp, err := client.ListFeaturesWithResponse(ctx, &openmeter.ListFeaturesParams{Page: &page, PageSize: &pageSize})
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.StatusCode(), resp.Body, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]provisionedFeature, len(features))
+	for _, f := range features {
+		byKey[f.Key] = f
+	}
+	return byKey, nil
+}
+
+// listEntitlements uses the entitlements endpoint filtered to subject rather
+// than the subject's own, which can't be paged through.
+func listEntitlements(ctx context.Context, client *openmeter.ClientWithResponses, subject string) (map[string]provisionedEntitlement, error) {
+	entitlements, err := listAll[provisionedEntitlement]("entitlements of "+subject, func(page int) (int, []byte, error) {
+		pageSize := provisionPageSize
+		resp, err := client.ListEntitlementsWithResponse(ctx, &openmeter.ListEntitlementsParams{Subject: &[]string{subject}, Page: &page, PageSize: &pageSize})
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.StatusCode(), resp.Body, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	byFeature := make(map[string]provisionedEntitlement, len(entitlements))
+	for _, e := range entitlements {
+		byFeature[e.FeatureKey] = e
+	}
+	return byFeature, nil
+}
+
+// wantEntitlement is what OpenMeter should hold for pe.
+func wantEntitlement(pe PlanEntitlement) provisionedEntitlement {
+	e := provisionedEntitlement{Type: pe.Type, FeatureKey: pe.Feature}
+	if pe.Period != "" {
+		e.UsagePeriod = &usagePeriod{Interval: pe.Period}
+	}
+	switch pe.Type {
+	case "metered":
+		limit, soft := pe.Limit, pe.SoftLimit
+		e.IssueAfterReset, e.IsSoftLimit = &limit, &soft
+	case "static":
+		e.Config = pe.Config
+	}
+	return e
+}
+
+// entitlementDiff describes how have differs from want, or returns "" if it
+// doesn't in any way the spec controls.
+func entitlementDiff(have provisionedEntitlement, want provisionedEntitlement) string {
+	if have.Type != want.Type {
+		return fmt.Sprintf("type %s -> %s", have.Type, want.Type)
+	}
+	var diffs []string
+	var haveInterval, wantInterval string
+	if have.UsagePeriod != nil {
+		haveInterval = have.UsagePeriod.Interval
+	}
+	if want.UsagePeriod != nil {
+		wantInterval = want.UsagePeriod.Interval
+	}
+	if haveInterval != wantInterval {
+		diffs = append(diffs, fmt.Sprintf("period %s -> %s", haveInterval, wantInterval))
+	}
+	switch want.Type {
+	case "metered":
+		var haveLimit float64
+		var haveSoft bool
+		if have.IssueAfterReset != nil {
+			haveLimit = *have.IssueAfterReset
+		}
+		if have.IsSoftLimit != nil {
+			haveSoft = *have.IsSoftLimit
+		}
+		if haveLimit != *want.IssueAfterReset {
+			diffs = append(diffs, fmt.Sprintf("limit %s -> %s", formatLimit(haveLimit), formatLimit(*want.IssueAfterReset)))
+		}
+		if haveSoft != *want.IsSoftLimit {
+			diffs = append(diffs, fmt.Sprintf("soft limit %v -> %v", haveSoft, *want.IsSoftLimit))
+		}
+	case "static":
+		if !sameJSON(have.Config, want.Config) {
+			diffs = append(diffs, fmt.Sprintf("config %s -> %s", configJSON(have.Config), configJSON(want.Config)))
+		}
+	}
+	return strings.Join(diffs, ", ")
+}
+
+func formatLimit(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+
+// configJSON returns a static entitlement's config as JSON. OpenMeter takes
+// it as an object and returns it as a string holding the object.
+func configJSON(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+func sameJSON(a json.RawMessage, b json.RawMessage) bool {
+	var va, vb any
+	json.Unmarshal([]byte(configJSON(a)), &va)
+	json.Unmarshal([]byte(configJSON(b)), &vb)
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
+
+// planProvisioning compares spec with what OpenMeter has and returns the
+// changes that would make them match, meters first, then features, then
+// entitlements, since each needs the one before. Nothing is changed.
+//
+// OpenMeter can't update any of the three in place. A feature or entitlement
+// that differs is archived and created again, which is what OpenMeter
+// suggests for entitlements and keeps the usage history, which lives on the
+// meter. A meter that differs is only reported: deleting it would delete its
+// usage. Entitlements for features outside the spec are left alone.
+func planProvisioning(ctx context.Context, client *openmeter.ClientWithResponses, spec ProvisioningSpec) ([]provisionChange, error) {
+	var changes []provisionChange
+
+	metersResp, err := client.ListMetersWithResponse(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list meters: %w", err)
+	}
+	if metersResp.JSON200 == nil {
+		return nil, openMeterError("list meters", metersResp.StatusCode(), metersResp.Body)
+	}
+	meters := make(map[string]openmeter.Meter)
+	for _, m := range *metersResp.JSON200 {
+		meters[m.Slug] = m
+	}
+	for _, ms := range spec.Meters {
+		want := openmeter.Meter{
+			Slug:          ms.Slug,
+			EventType:     ms.EventType,
+			Aggregation:   ms.Aggregation,
+			ValueProperty: ms.ValueProperty,
+			GroupBy:       ms.GroupBy,
+			WindowSize:    ms.WindowSize,
+		}
+		have, ok := meters[ms.Slug]
+		if !ok {
+			changes = append(changes, provisionChange{
+				op: '+', kind: "meter", name: ms.Slug,
+				detail: describeMeter(want),
+				apply: func(ctx context.Context) error {
+					resp, err := client.CreateMeterWithResponse(ctx, want)
+					if err != nil {
+						return fmt.Errorf("failed to create meter %s: %w", want.Slug, err)
+					}
+					if resp.StatusCode() >= 400 {
+						return openMeterError("create meter "+want.Slug, resp.StatusCode(), resp.Body)
+					}
+					return nil
+				},
+			})
+			continue
+		}
+		if have.EventType != want.EventType || have.Aggregation != want.Aggregation ||
+			have.ValueProperty != want.ValueProperty || !maps.Equal(have.GroupBy, want.GroupBy) ||
+			(want.WindowSize != "" && have.WindowSize != want.WindowSize) {
+			changes = append(changes, provisionChange{
+				op: '!', kind: "meter", name: ms.Slug,
+				detail: fmt.Sprintf("have %s, want %s; meters can't be changed without losing their usage",
+					describeMeter(have), describeMeter(want)),
+			})
+		}
+	}
+
+	features, err := listFeatures(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	managed := make(map[string]bool, len(spec.Features))
+	for _, fs := range spec.Features {
+		managed[fs.Key] = true
+		body := openmeter.FeatureCreateInputs{Key: fs.Key, Name: fs.Name}
+		if fs.MeterSlug != "" {
+			body.MeterSlug = &fs.MeterSlug
+		}
+		if len(fs.GroupByFilters) > 0 {
+			body.MeterGroupByFilters = &fs.GroupByFilters
+		}
+		create := func(ctx context.Context) error {
+			resp, err := client.CreateFeatureWithResponse(ctx, body)
+			if err != nil {
+				return fmt.Errorf("failed to create feature %s: %w", body.Key, err)
+			}
+			if resp.StatusCode() >= 400 {
+				return openMeterError("create feature "+body.Key, resp.StatusCode(), resp.Body)
+			}
+			return nil
+		}
+
+		have, ok := features[fs.Key]
+		switch {
+		case !ok:
+			changes = append(changes, provisionChange{op: '+', kind: "feature", name: fs.Key, detail: "on meter " + fs.MeterSlug, apply: create})
+		case have.MeterSlug != fs.MeterSlug || !maps.Equal(have.MeterGroupByFilters, fs.GroupByFilters) || have.Name != fs.Name:
+			id := have.ID
+			changes = append(changes, provisionChange{
+				op: '~', kind: "feature", name: fs.Key,
+				detail: fmt.Sprintf("%q on meter %s -> %q on meter %s", have.Name, have.MeterSlug, fs.Name, fs.MeterSlug),
+				apply: func(ctx context.Context) error {
+					resp, err := client.DeleteFeatureWithResponse(ctx, id)
+					if err != nil {
+						return fmt.Errorf("failed to archive feature %s: %w", fs.Key, err)
+					}
+					if resp.StatusCode() >= 400 {
+						return openMeterError("archive feature "+fs.Key, resp.StatusCode(), resp.Body)
+					}
+					return create(ctx)
+				},
+			})
+		}
+	}
+
+	plans := make(map[string]UsagePlan, len(spec.Plans))
+	for _, p := range spec.Plans {
+		plans[p.Name] = p
+	}
+	for _, subject := range slices.Sorted(maps.Keys(spec.Subjects)) {
+		plan, ok := plans[spec.Subjects[subject]]
+		if !ok {
+			return nil, fmt.Errorf("subject %s is on unknown plan %q", subject, spec.Subjects[subject])
+		}
+		have, err := listEntitlements(ctx, client, subject)
+		if err != nil {
+			return nil, err
+		}
+
+		inPlan := make(map[string]bool, len(plan.Entitlements))
+		for _, pe := range plan.Entitlements {
+			inPlan[pe.Feature] = true
+			want := wantEntitlement(pe)
+			create := func(ctx context.Context) error {
+				body, err := json.Marshal(want)
+				if err != nil {
+					return err
+				}
+				resp, err := client.CreateEntitlementWithBodyWithResponse(ctx, subject, "application/json", bytes.NewReader(body))
+				if err != nil {
+					return fmt.Errorf("failed to create entitlement %s/%s: %w", subject, want.FeatureKey, err)
+				}
+				if resp.StatusCode() >= 400 {
+					return openMeterError("create entitlement "+subject+"/"+want.FeatureKey, resp.StatusCode(), resp.Body)
+				}
+				return nil
+			}
+
+			name := subject + "/" + pe.Feature
+			current, ok := have[pe.Feature]
+			if !ok {
+				changes = append(changes, provisionChange{op: '+', kind: "entitlement", name: name, detail: describeEntitlement(want), apply: create})
+				continue
+			}
+			if diff := entitlementDiff(current, want); diff != "" {
+				id := current.ID
+				changes = append(changes, provisionChange{
+					op: '~', kind: "entitlement", name: name, detail: diff,
+					apply: func(ctx context.Context) error {
+						if err := deleteEntitlement(ctx, client, subject, id); err != nil {
+							return err
+						}
+						return create(ctx)
+					},
+				})
+			}
+		}
+
+		for _, feature := range slices.Sorted(maps.Keys(have)) {
+			if !managed[feature] || inPlan[feature] {
+				continue
+			}
+			id := have[feature].ID
+			changes = append(changes, provisionChange{
+				op: '-', kind: "entitlement", name: subject + "/" + feature, detail: "not in plan " + plan.Name,
+				apply: func(ctx context.Context) error {
+					return deleteEntitlement(ctx, client, subject, id)
+				},
+			})
+		}
+	}
+	return changes, nil
+}
+
+func deleteEntitlement(ctx context.Context, client *openmeter.ClientWithResponses, subject string, id string) error {
+	resp, err := client.DeleteEntitlementWithResponse(ctx, subject, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete entitlement %s of %s: %w", id, subject, err)
+	}
+	if resp.StatusCode() >= 400 {
+		return openMeterError("delete entitlement "+id+" of "+subject, resp.StatusCode(), resp.Body)
+	}
+	return nil
+}
+
+func describeMeter(m openmeter.Meter) string {
+	s := fmt.Sprintf("%s of %s", m.Aggregation, m.EventType)
+	if m.ValueProperty != "" {
+		s += " " + m.ValueProperty
+	}
+	return s
+}
+
+func describeEntitlement(e provisionedEntitlement) string {
+	switch e.Type {
+	case "metered":
+		var limit float64
+		if e.IssueAfterReset != nil {
+			limit = *e.IssueAfterReset
+		}
+		s := formatLimit(limit)
+		if e.UsagePeriod != nil {
+			s += " per " + e.UsagePeriod.Interval
+		}
+		if e.IsSoftLimit != nil && *e.IsSoftLimit {
+			s += " (soft)"
+		}
+		return s
+	case "static":
+		return "config " + configJSON(e.Config)
+	default:
+		return e.Type
+	}
+}
+
+// provision prints the changes spec needs and, if apply is set, makes them
+// in order, stopping at the first failure. Running it again afterwards
+// prints only conflicts.
+func provision(ctx context.Context, client *openmeter.ClientWithResponses, spec ProvisioningSpec, apply bool, w io.Writer) error {
+	changes, err := planProvisioning(ctx, client, spec)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "OpenMeter is up to date")
+		return nil
+	}
+	for _, c := range changes {
+		fmt.Fprintln(w, c)
+	}
+	if !apply {
+		return nil
+	}
+	for _, c := range changes {
+		if c.apply == nil {
+			continue
+		}
+		if err := c.apply(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// main25 provisions OpenMeter from the plans in PLANS_FILE, or the default
+// plans if it isn't set, on OPENMETER_URL. It only prints the diff unless
+// APPLY=1.
+func main25() {
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Warning: Error loading .env file: %v", err)
+	}
+	spec := defaultProvisioningSpec
+	if path := os.Getenv("PLANS_FILE"); path != "" {
+		var err error
+		if spec, err = loadProvisioningSpec(path); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	client, err := newOpenMeterClient(openMeterConfigFromEnv())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := provision(context.Background(), client, spec, os.Getenv("APPLY") == "1", os.Stdout); err != nil {
+		log.Fatalf("provisioning failed: %v", err)
+	}
+}
+
+// main26 provisions the stand-in: the first run creates everything, the
+// second finds nothing to do, and the third moves the customer to another
+// plan and changes a meter, which is only reported.
+func main26() {
+	ctx := context.Background()
+	om := startStandinOpenMeter()
+	defer om.Close()
+	client, err := openmeter.NewAuthClientWithResponses(om.URL(), "test-token")
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+
+	spec := defaultProvisioningSpec
+	for i, step := range []string{"first run", "second run", "customer123 moves to pro"} {
+		if i == 2 {
+			spec.Subjects = map[string]string{"customer123": "pro", "customer456": "free"}
+			spec.Meters = slices.Clone(spec.Meters)
+			spec.Meters[0].Aggregation = models.MeterAggregationUniqueCount
+		}
+		fmt.Printf("=== %s ===\n", step)
+		if err := provision(ctx, client, spec, true, os.Stdout); err != nil {
+			log.Fatalf("provisioning failed: %v", err)
+		}
+	}
+	fmt.Println("=== after ===")
+	if err := provision(ctx, client, spec, false, os.Stdout); err != nil {
+		log.Fatalf("provisioning failed: %v", err)
+	}
+}
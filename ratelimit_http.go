@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitConfig is what rateLimit checks each request against.
+type RateLimitConfig struct {
+	// Limiters are checked in order and all of them have to allow the
+	// request. Slots held by earlier limiters are released when a later one
+	// denies it, and window units they spent are refunded.
+	Limiters []Limiter
+	// Subject is who the request is for; an empty subject is a 401.
+	// Defaults to the X-User-ID header.
+	Subject func(r *http.Request) string
+	// Endpoint is what the request is counted against. Defaults to
+	// endpointFromRoute.
+	Endpoint func(r *http.Request) string
+	// Cost is how many tokens the request takes. Defaults to 1.
+	Cost func(r *http.Request) int64
+	// FailOpen lets requests through when a limiter errors, instead of
+	// answering 503.
+	FailOpen bool
+}
+
+// subjectFromHeader reads the subject from a header set by whatever
+// authenticated the request in front of us.
+func subjectFromHeader(name string) func(r *http.Request) string {
+	return func(r *http.Request) string { return r.Header.Get(name) }
+}
+
+// endpointFromRoute is the ServeMux pattern the request matched, such as
+// "POST /v1/images", so requests for different IDs on one route share a
+// limit. Outside a ServeMux it falls back to the path.
+func endpointFromRoute(r *http.Request) string {
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	return r.URL.Path
+}
+
+type rateLimitSubjectKey struct{}
+
+// rateLimitSubject is the subject rateLimit admitted the request for.
+func rateLimitSubject(ctx context.Context) string {
+	subject, _ := ctx.Value(rateLimitSubjectKey{}).(string)
+	return subject
+}
+
+// rateLimit checks every request against cfg.Limiters before passing it on.
+// A denied request gets a 429 with Retry-After; every answer from a limiter
+// also sets the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers of the IETF RateLimit fields draft, for the limit with the least
+// room left. Slots taken for the request are released when next returns.
+func rateLimit(cfg RateLimitConfig) func(next http.Handler) http.Handler {
+	if cfg.Subject == nil {
+		cfg.Subject = subjectFromHeader("X-User-ID")
+	}
+	if cfg.Endpoint == nil {
+		cfg.Endpoint = endpointFromRoute
+	}
+	if cfg.Cost == nil {
+		cfg.Cost = func(*http.Request) int64 { return 1 }
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			subject := cfg.Subject(r)
+			if subject == "" {
+				http.Error(w, "missing subject", http.StatusUnauthorized)
+				return
+			}
+			endpoint := cfg.Endpoint(r)
+			tokens := cfg.Cost(r)
+
+			d, release, err := admit(r.Context(), cfg.Limiters, subject, endpoint, tokens, cfg.FailOpen)
+			if err != nil {
+				log.Printf("rate limit check failed for %s on %s: %v", subject, endpoint, err)
+				http.Error(w, "rate limit check failed", http.StatusServiceUnavailable)
+				return
+			}
+			setRateLimitHeaders(w.Header(), d)
+			if !d.Allowed {
+				w.Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(d.ResetAfter), 10))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			defer release()
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateLimitSubjectKey{}, subject)))
+		})
+	}
+}
+
+// setRateLimitHeaders describes d, unless it has no limit to describe, as
+// with a boolean entitlement.
+func setRateLimitHeaders(h http.Header, d Decision) {
+	if d.Remaining < 0 || d.Limit <= 0 {
+		return
+	}
+	h.Set("RateLimit-Limit", strconv.FormatInt(d.Limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(d.Remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(d.ResetAfter), 10))
+}
+
+// ceilSeconds rounds d up to whole seconds, and to at least one, so a client
+// told to wait never retries straight away.
+func ceilSeconds(d time.Duration) int64 {
+	return max(int64(math.Ceil(d.Seconds())), 1)
+}
+
+// main32 serves image generation through handleImageGenRequest, behind a
+// 5-per-minute window and 2 concurrent requests on a Redis stand-in and the
+// gputimecheck entitlement on an OpenMeter stand-in. It prints the status
+// and RateLimit headers for a request without a subject, a run through the
+// window, concurrent requests and a subject without access, shows a window
+// refunded when a limiter after it denies, then a subject whose entitlement
+// can't be read.
+func main32() {
+	ctx := context.Background()
+	server, err := startStandinRedis()
+	if err != nil {
+		log.Fatalf("failed to start stand-in: %v", err)
+	}
+	defer server.Close()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+	defer rdb.Close()
+	fns, err := loadLimiterFunctions(ctx, rdb)
+	if err != nil {
+		log.Fatalf("failed to load limiter library: %v", err)
+	}
+
+	om := startStandinOpenMeter()
+	defer om.Close()
+	yes, no := true, false
+	balance, usage, zero := 540.0, 60.0, 0.0
+	om.setEntitlement("customer123", "gputimecheck", openmeter.EntitlementValue{HasAccess: &yes, Balance: &balance, Usage: &usage, Overage: &zero})
+	om.setEntitlement("customer456", "gputimecheck", openmeter.EntitlementValue{HasAccess: &yes})
+	spent := 600.0
+	om.setEntitlement("customer789", "gputimecheck", openmeter.EntitlementValue{HasAccess: &no, Balance: &zero, Usage: &spent, Overage: &zero})
+	now := time.Now()
+	om.setUsagePeriod("customer789", "gputimecheck", openmeter.Period{From: now.Add(-22 * time.Hour), To: now.Add(2 * time.Hour)})
+	om.failEntitlement("customer500", "gputimecheck", http.StatusInternalServerError)
+
+	svc, err := NewImageGenServiceWithConfig(OpenMeterConfig{BaseURL: om.URL(), APIKey: "test-token", MaxRetries: -1})
+	if err != nil {
+		log.Fatalf("failed to create service: %v", err)
+	}
+	generate := func(ctx context.Context) (int, error) {
+		time.Sleep(50 * time.Millisecond)
+		return 1, nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/images", handleImageGenRequest(svc, generate,
+		newConcurrencyLimiter(fns, 2, time.Minute),
+		newWindowLimiter(rdb, []WindowLimit{{Name: "minute", Limit: 5, Period: time.Minute}}),
+	))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	post := func(subject string) string {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/images", nil)
+		if subject != "" {
+			req.Header.Set("X-User-ID", subject)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err.Error()
+		}
+		resp.Body.Close()
+		line := fmt.Sprintf("%d", resp.StatusCode)
+		for _, h := range []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"} {
+			if v := resp.Header.Get(h); v != "" {
+				line += fmt.Sprintf(" %s=%s", h, v)
+			}
+		}
+		return line
+	}
+
+	fmt.Println("=== No subject ===")
+	fmt.Println(post(""))
+
+	fmt.Println("\n=== 7 requests against 5 per minute ===")
+	for i := 0; i < 7; i++ {
+		fmt.Printf("%d: %s\n", i+1, post("customer123"))
+	}
+
+	fmt.Println("\n=== 5 concurrent requests, 2 at a time ===")
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			line := post("customer456")
+			mu.Lock()
+			counts[line[:3]]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("200: %d, 429: %d\n", counts["200"], counts["429"])
+	fmt.Printf("After they returned: %s\n", post("customer456"))
+
+	fmt.Println("\n=== Entitlement used up ===")
+	fmt.Println(post("customer789"))
+
+	fmt.Println("\n=== Window checked before the entitlement that denies ===")
+	window := newWindowLimiter(rdb, []WindowLimit{{Name: "minute", Limit: 5, Period: time.Minute}})
+	for i := 0; i < 2; i++ {
+		d, _, err := admit(ctx, []Limiter{window, svc.limiter(svc.feature)}, "customer789", "refunds", 1, false)
+		if err != nil {
+			log.Fatalf("failed to admit: %v", err)
+		}
+		fmt.Printf("%d: allowed=%v\n", i+1, d.Allowed)
+	}
+	d, err := window.Allow(ctx, "customer789", "refunds", 0)
+	fmt.Printf("window remaining after both: %d %v\n", d.Remaining, err)
+
+	fmt.Println("\n=== Entitlement unreadable ===")
+	fmt.Println(post("customer500"))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	maxFailoverRetries = 10
+	failoverRetryDelay = 50 * time.Millisecond
+)
+
+// isFailoverErr reports errors that mean the command was not applied because
+// the primary is being switched: the old primary has been demoted, the new one
+// isn't ready, or nothing is listening yet. These are safe to retry.
+func isFailoverErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, prefix := range []string{"READONLY", "MASTERDOWN", "LOADING"} {
+		if redis.HasErrorPrefix(err, prefix) {
+			return true
+		}
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// standinSentinel answers the few Sentinel commands go-redis's failover client
+// uses and publishes +switch-master when failover is called.
+type standinSentinel struct {
+	server     *redcon.Server
+	addr       string
+	pubsub     redcon.PubSub
+	masterName string
+
+	mu     sync.Mutex
+	master string
+}
+
+func startStandinSentinel(masterName string, masterAddr string) (*standinSentinel, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	s := &standinSentinel{
+		addr:       ln.Addr().String(),
+		masterName: masterName,
+		master:     masterAddr,
+	}
+	s.server = redcon.NewServer(s.addr, s.serveRESP, nil, nil)
+	go s.server.Serve(ln)
+	return s, nil
+}
+
+func (s *standinSentinel) Addr() string { return s.addr }
+
+func (s *standinSentinel) Close() error { return s.server.Close() }
+
+func (s *standinSentinel) serveRESP(conn redcon.Conn, cmd redcon.Command) {
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "ping":
+		conn.WriteString("PONG")
+	case "client":
+		conn.WriteString("OK")
+	case "subscribe":
+		for _, channel := range cmd.Args[1:] {
+			s.pubsub.Subscribe(conn, string(channel))
+		}
+	case "sentinel":
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for 'sentinel' command")
+			return
+		}
+		switch strings.ToLower(string(cmd.Args[1])) {
+		case "get-master-addr-by-name":
+			if string(cmd.Args[2]) != s.masterName {
+				conn.WriteNull()
+				return
+			}
+			s.mu.Lock()
+			host, port, _ := net.SplitHostPort(s.master)
+			s.mu.Unlock()
+			conn.WriteArray(2)
+			conn.WriteBulkString(host)
+			conn.WriteBulkString(port)
+		case "sentinels", "replicas", "slaves":
+			conn.WriteArray(0)
+		default:
+			conn.WriteError("ERR unsupported SENTINEL subcommand")
+		}
+	default:
+		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+	}
+}
+
+// failover points the master at newAddr and tells subscribed clients.
+func (s *standinSentinel) failover(newAddr string) {
+	s.mu.Lock()
+	oldAddr := s.master
+	s.master = newAddr
+	s.mu.Unlock()
+
+	oldHost, oldPort, _ := net.SplitHostPort(oldAddr)
+	newHost, newPort, _ := net.SplitHostPort(newAddr)
+	s.pubsub.Publish("+switch-master", strings.Join([]string{s.masterName, oldHost, oldPort, newHost, newPort}, " "))
+}
+
+// main13 runs each Redis strategy through a Sentinel failover: a primary and a
+// replica stand-in with 20ms asynchronous replication, and a primary switch a
+// third of the way through the run. Writes since the last replication are lost
+// with the old primary, so every strategy over-admits a little; the table shows
+// by how much, and how many requests errored while the client moved over.
+func main13() {
+	const failoverLimit = 500
+	ctx := context.Background()
+	userID := "test_user"
+	endpointID := "test_endpoint"
+
+	strategies := []struct {
+		name   string
+		update func(rdb redis.UniversalClient) (Decision, error)
+	}{
+		{"setnx", func(rdb redis.UniversalClient) (Decision, error) {
+			return updateLimiterStateWithLock(ctx, rdb, userID, endpointID, 1)
+		}},
+		{"watch", func(rdb redis.UniversalClient) (Decision, error) {
+			return UpdateLimiterState3(ctx, rdb, userID, endpointID, 1)
+		}},
+		{"incrby", func(rdb redis.UniversalClient) (Decision, error) {
+			return updateLimiterState2(ctx, rdb, userID, endpointID, 1)
+		}},
+	}
+
+	fmt.Printf("%-8s %8s %8s %8s %10s\n", "strategy", "allowed", "denied", "errors", "overshoot")
+	for _, strategy := range strategies {
+		primary, err := startStandinRedis()
+		if err != nil {
+			log.Fatalf("failed to start primary: %v", err)
+		}
+		replica, err := startStandinRedis()
+		if err != nil {
+			log.Fatalf("failed to start replica: %v", err)
+		}
+		sentinel, err := startStandinSentinel("mymaster", primary.Addr())
+		if err != nil {
+			log.Fatalf("failed to start sentinel: %v", err)
+		}
+
+		rdb := redis.NewUniversalClient(&redis.UniversalOptions{
+			MasterName: "mymaster",
+			Addrs:      []string{sentinel.Addr()},
+		})
+
+		// SetNX and INCRBY default to a 500 limit; WATCH needs its state seeded
+		seed, _ := encodeState(LimiterState{
+			SlidingWindows: []SlidingWindow{{Limit: failoverLimit, StartTime: time.Now()}},
+			FixedWindow:    []FixedWindow{{Limit: failoverLimit, StartTime: time.Now()}},
+		})
+		rdb.Set(ctx, limiterKey(userID, endpointID), seed, 24*time.Hour)
+
+		stopReplication := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(20 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					replica.store.copyFrom(primary.store)
+				case <-stopReplication:
+					return
+				}
+			}
+		}()
+
+		var attempts atomic.Int64
+		var switchOnce sync.Once
+		failoverAt := int64(numRoutines * updatesPerRoutine / 3)
+		failover := func() {
+			// No final sync: whatever the replica hasn't seen yet is lost
+			close(stopReplication)
+			primary.readOnly.Store(true)
+			sentinel.failover(replica.Addr())
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var allowed, denied, failed int
+		for i := 0; i < numRoutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < updatesPerRoutine; j++ {
+					if attempts.Add(1) == failoverAt {
+						switchOnce.Do(failover)
+					}
+					d, err := strategy.update(rdb)
+					mu.Lock()
+					switch {
+					case err != nil:
+						failed++
+					case d.Allowed:
+						allowed++
+					default:
+						denied++
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		overshoot := allowed - failoverLimit
+		if overshoot < 0 {
+			overshoot = 0
+		}
+		fmt.Printf("%-8s %8d %8d %8d %10d\n", strategy.name, allowed, denied, failed, overshoot)
+
+		rdb.Close()
+		sentinel.Close()
+		primary.Close()
+		replica.Close()
+	}
+}
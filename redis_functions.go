@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// limiterLibraryName carries the library version. A change to any function
+// body gets a new version, so during a rollout old and new clients each call
+// the functions they were written against instead of REPLACE-ing each other's.
+const limiterLibraryName = "limiter_v2"
+
+// limiterFunctionBodies are the limiter operations, written once against
+// keys/args so the same body can be registered as a Redis Function or, on
+// servers without FUNCTION (Redis < 7, Garnet), sent with EVAL.
+var limiterFunctionBodies = []struct {
+	name string
+	body string
+}{
+	// check_incr: KEYS = one counter per window
+	// ARGV[1] = tokens, then per window i: ARGV[2i] = limit, ARGV[2i+1] = TTL in ms
+	// Returns {allowed, {{count, limit, remaining, pttl}, ...}}. Nothing is
+	// incremented unless every window has room; a window's TTL is set when its
+	// counter is created. windowsScript is its EVAL form.
+	{"check_incr", `
+	local tokens = tonumber(args[1])
+	local counts = {}
+	local allowed = 1
+
+	-- Every window has to have room before any of them is incremented
+	for i, key in ipairs(keys) do
+		counts[i] = tonumber(redis.call('GET', key) or '0')
+		if counts[i] + tokens > tonumber(args[2 * i]) then
+			allowed = 0
+		end
+	end
+
+	local windows = {}
+	for i, key in ipairs(keys) do
+		local limit = tonumber(args[2 * i])
+		if allowed == 1 then
+			counts[i] = redis.call('INCRBY', key, tokens)
+			if counts[i] == tokens then
+				redis.call('PEXPIRE', key, args[2 * i + 1])
+			end
+		end
+		windows[i] = {counts[i], limit, math.max(limit - counts[i], 0), redis.call('PTTL', key)}
+	end
+
+	return {allowed, windows}
+`},
+	// token_bucket: KEYS[1] = bucket hash {tokens, ts}
+	// ARGV[1] = capacity, ARGV[2] = refill per second, ARGV[3] = tokens requested
+	// Returns {allowed, tokens left, retry after in ms}.
+	{"token_bucket", `
+	local capacity = tonumber(args[1])
+	local rate = tonumber(args[2])
+	local requested = tonumber(args[3])
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	local bucket = redis.call('HMGET', keys[1], 'tokens', 'ts')
+	local level = tonumber(bucket[1]) or capacity
+	local ts = tonumber(bucket[2]) or now
+	level = math.min(capacity, level + (now - ts) * rate / 1000)
+	local allowed = 0
+	local retry_after = 0
+	if level >= requested then
+		level = level - requested
+		allowed = 1
+	else
+		retry_after = math.ceil((requested - level) * 1000 / rate)
+	end
+	redis.call('HSET', keys[1], 'tokens', tostring(level), 'ts', now)
+	redis.call('PEXPIRE', keys[1], math.ceil(capacity * 1000 / rate))
+	return {allowed, math.floor(level), retry_after}
+`},
+	// acquire: KEYS[1] = sorted set of lease IDs scored by expiry in ms
+	// ARGV[1] = limit, ARGV[2] = lease ID, ARGV[3] = lease TTL in ms
+	// Returns {acquired, leases held}. Expired leases are dropped first, so a
+	// client that dies without releasing only holds its slot for the TTL.
+	{"acquire", `
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	redis.call('ZREMRANGEBYSCORE', keys[1], '-inf', now)
+	local held = redis.call('ZCARD', keys[1])
+	if held >= tonumber(args[1]) then
+		return {0, held}
+	end
+	redis.call('ZADD', keys[1], now + tonumber(args[3]), args[2])
+	redis.call('PEXPIRE', keys[1], args[3])
+	return {1, held + 1}
+`},
+	// release: KEYS[1] = the acquire set, ARGV[1] = lease ID
+	// Returns 1 if the lease was still held.
+	{"release", `
+	return redis.call('ZREM', keys[1], args[1])
+`},
+}
+
+func limiterFunctionName(name string) string {
+	return limiterLibraryName + "_" + name
+}
+
+// limiterFunctionBody is the body of the library function called name.
+func limiterFunctionBody(name string) string {
+	for _, fn := range limiterFunctionBodies {
+		if fn.name == name {
+			return fn.body
+		}
+	}
+	panic("no limiter function " + name)
+}
+
+// limiterLibraryCode is the FUNCTION LOAD payload.
+func limiterLibraryCode() string {
+	var b strings.Builder
+	b.WriteString("#!lua name=" + limiterLibraryName + "\n")
+	for _, fn := range limiterFunctionBodies {
+		fmt.Fprintf(&b, "redis.register_function('%s', function(keys, args)%send)\n", limiterFunctionName(fn.name), fn.body)
+	}
+	return b.String()
+}
+
+// limiterEvalScript is the EVAL form of one function body.
+func limiterEvalScript(body string) string {
+	return "local keys, args = KEYS, ARGV" + body
+}
+
+// limiterFunctions calls the limiter library with FCALL, or with EVALSHA/EVAL
+// when the server has no FUNCTION command.
+type limiterFunctions struct {
+	rdb          redis.UniversalClient
+	useFunctions bool
+	scripts      map[string]*redis.Script
+}
+
+// loadLimiterFunctions loads the library once, on every primary when rdb is a
+// cluster client. If the server doesn't know FUNCTION it falls back to EVAL
+// rather than failing, so the same code runs against older Redis and Garnet.
+func loadLimiterFunctions(ctx context.Context, rdb redis.UniversalClient) (*limiterFunctions, error) {
+	f := &limiterFunctions{rdb: rdb, scripts: make(map[string]*redis.Script)}
+	for _, fn := range limiterFunctionBodies {
+		f.scripts[limiterFunctionName(fn.name)] = redis.NewScript(limiterEvalScript(fn.body))
+	}
+
+	err := f.load(ctx)
+	switch {
+	case err == nil:
+		f.useFunctions = true
+	case isUnknownCommandErr(err):
+		log.Printf("FUNCTION not supported, falling back to EVAL: %v", err)
+	default:
+		return nil, fmt.Errorf("failed to load %s: %w", limiterLibraryName, err)
+	}
+	return f, nil
+}
+
+func (f *limiterFunctions) load(ctx context.Context) error {
+	code := limiterLibraryCode()
+	loadOn := func(ctx context.Context, c redis.Cmdable) error {
+		err := c.FunctionLoad(ctx, code).Err()
+		if err != nil && strings.Contains(err.Error(), "already exists") {
+			// Same versioned name, so the same code
+			return nil
+		}
+		return err
+	}
+	if cluster, ok := f.rdb.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return loadOn(ctx, node)
+		})
+	}
+	return loadOn(ctx, f.rdb)
+}
+
+func isUnknownCommandErr(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "unknown command")
+}
+
+// call runs one library function. A primary that lost its functions (a
+// restart without persistence, a node added to the cluster) answers "Function
+// not found"; the library is loaded again and the call retried once.
+func (f *limiterFunctions) call(ctx context.Context, name string, keys []string, args ...interface{}) ([]interface{}, error) {
+	fullName := limiterFunctionName(name)
+	var res interface{}
+	var err error
+	if f.useFunctions {
+		res, err = f.rdb.FCall(ctx, fullName, keys, args...).Result()
+		if err != nil && strings.Contains(err.Error(), "Function not found") {
+			if err = f.load(ctx); err == nil {
+				res, err = f.rdb.FCall(ctx, fullName, keys, args...).Result()
+			}
+		}
+	} else {
+		res, err = f.scripts[fullName].Run(ctx, f.rdb, keys, args...).Result()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", fullName, err)
+	}
+	if values, ok := res.([]interface{}); ok {
+		return values, nil
+	}
+	return []interface{}{res}, nil
+}
+
+// checkAndIncrement adds tokens to every window if all of them have room and
+// returns the counts after the call.
+func (f *limiterFunctions) checkAndIncrement(ctx context.Context, keys []string, limits []int64, ttls []time.Duration, tokens int64) (bool, []int64, error) {
+	if len(limits) != len(keys) || len(ttls) != len(keys) {
+		return false, nil, fmt.Errorf("need a limit and TTL for each of %d windows", len(keys))
+	}
+	args := []interface{}{tokens}
+	for i := range keys {
+		args = append(args, limits[i], ttls[i].Milliseconds())
+	}
+	values, err := f.call(ctx, "check_incr", keys, args...)
+	if err != nil {
+		return false, nil, err
+	}
+	var windows []interface{}
+	if len(values) == 2 {
+		windows, _ = values[1].([]interface{})
+	}
+	if len(windows) != len(keys) {
+		return false, nil, fmt.Errorf("unexpected check_incr result: %v", values)
+	}
+	counts := make([]int64, len(keys))
+	for i, w := range windows {
+		if fields, ok := w.([]interface{}); ok && len(fields) == 4 {
+			counts[i], _ = fields[0].(int64)
+		}
+	}
+	return values[0] == int64(1), counts, nil
+}
+
+// takeTokens takes tokens from a bucket holding up to capacity and refilling
+// at refillPerSec. When denied, retryAfter is how long until there's enough.
+func (f *limiterFunctions) takeTokens(ctx context.Context, key string, capacity int64, refillPerSec float64, tokens int64) (allowed bool, remaining int64, retryAfter time.Duration, err error) {
+	values, err := f.call(ctx, "token_bucket", []string{key}, capacity, refillPerSec, tokens)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if len(values) != 3 {
+		return false, 0, 0, fmt.Errorf("unexpected token_bucket result: %v", values)
+	}
+	remaining, _ = values[1].(int64)
+	retryMs, _ := values[2].(int64)
+	return values[0] == int64(1), remaining, time.Duration(retryMs) * time.Millisecond, nil
+}
+
+// acquire takes one of limit concurrency slots under leaseID and returns how
+// many are held afterwards. The lease lapses after ttl if it isn't released.
+func (f *limiterFunctions) acquire(ctx context.Context, key string, leaseID string, limit int64, ttl time.Duration) (bool, int64, error) {
+	values, err := f.call(ctx, "acquire", []string{key}, limit, leaseID, ttl.Milliseconds())
+	if err != nil {
+		return false, 0, err
+	}
+	if len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected acquire result: %v", values)
+	}
+	held, _ := values[1].(int64)
+	return values[0] == int64(1), held, nil
+}
+
+func (f *limiterFunctions) release(ctx context.Context, key string, leaseID string) error {
+	_, err := f.call(ctx, "release", []string{key}, leaseID)
+	return err
+}
+
+// main14 runs the three library operations from 10 goroutines, once against a
+// stand-in with FUNCTION support and once against one without, where the
+// client falls back to EVAL. Both should enforce the same limits.
+func main14() {
+	ctx := context.Background()
+	userID := "test_user"
+	endpointID := "test_endpoint"
+
+	for _, withFunctions := range []bool{true, false} {
+		server, err := startStandinRedis()
+		if err != nil {
+			log.Fatalf("failed to start stand-in: %v", err)
+		}
+		server.noFunctions = !withFunctions
+		rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+
+		lib, err := loadLimiterFunctions(ctx, rdb)
+		if err != nil {
+			log.Fatalf("failed to load limiter library: %v", err)
+		}
+		mode := "EVAL"
+		if lib.useFunctions {
+			mode = "FCALL"
+		}
+		fmt.Printf("\n%s (server has FUNCTION: %v)\n", mode, withFunctions)
+
+		// Per-minute, per-3-hours and per-day windows of one plan
+		keys := []string{
+			windowKey("minute", userID, endpointID),
+			windowKey("3hours", userID, endpointID),
+			windowKey("day", userID, endpointID),
+		}
+		limits := []int64{100, 300, 500}
+		ttls := []time.Duration{time.Minute, 3 * time.Hour, 24 * time.Hour}
+
+		var windowAllowed, bucketAllowed, acquired, maxHeld atomic.Int64
+		var held atomic.Int64
+		var wg sync.WaitGroup
+		start := time.Now()
+		for i := 0; i < numRoutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < updatesPerRoutine; j++ {
+					ok, _, err := lib.checkAndIncrement(ctx, keys, limits, ttls, 1)
+					if err != nil {
+						log.Printf("check_incr: %v", err)
+					} else if ok {
+						windowAllowed.Add(1)
+					}
+
+					ok, _, _, err = lib.takeTokens(ctx, windowKey("bucket", userID, endpointID), 50, 10, 1)
+					if err != nil {
+						log.Printf("token_bucket: %v", err)
+					} else if ok {
+						bucketAllowed.Add(1)
+					}
+
+					leaseID := uuid.NewString()
+					concurrencyKey := windowKey("concurrency", userID, endpointID)
+					ok, _, err = lib.acquire(ctx, concurrencyKey, leaseID, 5, time.Second)
+					if err != nil {
+						log.Printf("acquire: %v", err)
+						continue
+					}
+					if !ok {
+						continue
+					}
+					acquired.Add(1)
+					if n := held.Add(1); n > maxHeld.Load() {
+						maxHeld.Store(n)
+					}
+					time.Sleep(100 * time.Microsecond)
+					held.Add(-1)
+					if err := lib.release(ctx, concurrencyKey, leaseID); err != nil {
+						log.Printf("release: %v", err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		counts := make([]int64, len(keys))
+		for i, key := range keys {
+			counts[i], _ = rdb.Get(ctx, key).Int64()
+		}
+		fmt.Printf("windows:      %d allowed, counts %v against limits %v\n", windowAllowed.Load(), counts, limits)
+		fmt.Printf("token bucket: %d allowed (capacity 50, 10/s over %v)\n", bucketAllowed.Load(), time.Since(start).Round(time.Millisecond))
+		fmt.Printf("concurrency:  %d acquired, at most %d held at once (limit 5)\n", acquired.Load(), maxHeld.Load())
+
+		rdb.Close()
+		server.Close()
+	}
+}
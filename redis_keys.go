@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// All Redis keys for one user/endpoint pair share the hash tag
+// {userID:endpointID}, so on Redis Cluster (or sharded Garnet) they land in
+// the same slot and multi-key transactions and scripts don't fail with
+// CROSSSLOT.
+//
+// Keys used to be untagged: ratelimit:<userID>:<endpointID> for the state and
+// ratelimit:<window>:<userID>:<endpointID> for the window1-3, sliding and
+// fixed counters. The tagged names don't see those, so the cutover is:
+//
+//  1. Roll out processes on the tagged layout. Until the last process on the
+//     old layout stops, each layout only sees its own counts, so a pair can
+//     get up to twice its limit during the rollout.
+//  2. Once nothing writes the old names, run migrateLegacyKeys once. It adds
+//     each old counter into its tagged one, keeps the tagged state where
+//     there already is one, and deletes the old key.
+//
+// Old lock keys aren't moved; they're held for milliseconds and expire.
+
+func limiterHashTag(userID string, endpointID string) string {
+	return fmt.Sprintf("{%s:%s}", userID, endpointID)
+}
+
+// limiterKey holds a serialized LimiterState.
+func limiterKey(userID string, endpointID string) string {
+	return "ratelimit:" + limiterHashTag(userID, endpointID)
+}
+
+func limiterLockKey(userID string, endpointID string) string {
+	return "lock:" + limiterKey(userID, endpointID)
+}
+
+// windowKey holds the integer counter for one named window.
+func windowKey(window string, userID string, endpointID string) string {
+	return fmt.Sprintf("ratelimit:%s:%s", window, limiterHashTag(userID, endpointID))
+}
+
+// legacyWindows are the windows that had untagged keys.
+var legacyWindows = map[string]bool{"window1": true, "window2": true, "window3": true, "sliding": true, "fixed": true}
+
+// legacyKeyRename returns the tagged name of a key under the old layout, and
+// false for anything else. A user named like one of legacyWindows reads as
+// that window, as nothing in the old name tells them apart.
+func legacyKeyRename(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "ratelimit:")
+	if !ok || strings.Contains(rest, "{") || !strings.Contains(rest, ":") {
+		return "", false
+	}
+	if window, pair, ok := strings.Cut(rest, ":"); ok && legacyWindows[window] && strings.Contains(pair, ":") {
+		return fmt.Sprintf("ratelimit:%s:{%s}", window, pair), true
+	}
+	return "ratelimit:{" + rest + "}", true
+}
+
+// migrateLegacyKeys moves the keys still under the old layout to their tagged
+// names, scanning every primary of a cluster, and returns how many it moved.
+// Counters are added, so it must run once, after the rollout: a second run
+// finds nothing, but one cut short between adding a counter and deleting the
+// old key counts that key twice if rerun.
+func migrateLegacyKeys(ctx context.Context, rdb redis.UniversalClient) (int, error) {
+	var moved atomic.Int64
+	scan := func(ctx context.Context, node *redis.Client) error {
+		iter := node.Scan(ctx, 0, "ratelimit:*", 1000).Iterator()
+		for iter.Next(ctx) {
+			newKey, ok := legacyKeyRename(iter.Val())
+			if !ok {
+				continue
+			}
+			if err := migrateLegacyKey(ctx, rdb, iter.Val(), newKey); err != nil {
+				return err
+			}
+			moved.Add(1)
+		}
+		return iter.Err()
+	}
+
+	var err error
+	switch c := rdb.(type) {
+	case *redis.ClusterClient:
+		err = c.ForEachMaster(ctx, scan)
+	case *redis.Client:
+		err = scan(ctx, c)
+	default:
+		return 0, fmt.Errorf("failed to scan for legacy keys: unsupported client %T", rdb)
+	}
+	if err != nil {
+		return int(moved.Load()), fmt.Errorf("failed to migrate legacy keys: %w", err)
+	}
+	return int(moved.Load()), nil
+}
+
+func migrateLegacyKey(ctx context.Context, rdb redis.UniversalClient, oldKey string, newKey string) error {
+	value, err := rdb.Get(ctx, oldKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil // expired since the scan
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", oldKey, err)
+	}
+	ttl, err := rdb.PTTL(ctx, oldKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read the TTL of %s: %w", oldKey, err)
+	}
+
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		// A window counter: what the old processes counted adds to what
+		// the new ones did, and the counter keeps the TTL it already has
+		if err := rdb.IncrBy(ctx, newKey, n).Err(); err != nil {
+			return fmt.Errorf("failed to add %s to %s: %w", oldKey, newKey, err)
+		}
+		if ttl > 0 {
+			if err := rdb.ExpireNX(ctx, newKey, ttl).Err(); err != nil {
+				return fmt.Errorf("failed to set the TTL of %s: %w", newKey, err)
+			}
+		}
+	} else {
+		// A serialized state can't be merged, so a newer one wins
+		if ttl < 0 {
+			ttl = 0
+		}
+		if err := rdb.SetNX(ctx, newKey, value, ttl).Err(); err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %w", oldKey, newKey, err)
+		}
+	}
+
+	if err := rdb.Del(ctx, oldKey).Err(); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", oldKey, err)
+	}
+	return nil
+}
+
+// newRedisClient connects to REDIS_ADDRS, a comma-separated address list that
+// defaults to localhost:6379. One address gives a plain client; several give a
+// cluster client. If REDIS_MASTER_NAME is set, REDIS_ADDRS are Sentinel
+// addresses instead and the client follows that master through failovers.
+func newRedisClient() redis.UniversalClient {
+	addrs := []string{"localhost:6379"}
+	if env := os.Getenv("REDIS_ADDRS"); env != "" {
+		addrs = strings.Split(env, ",")
+	}
+	return redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      addrs,
+		MasterName: os.Getenv("REDIS_MASTER_NAME"),
+		DB:         0,
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RLSConfig maps Envoy rate limit descriptors onto window plans. A
+// descriptor is limited when it has both a UserKey and an EndpointKey entry,
+// such as the one Envoy builds from this on the route for /v1/images:
+//
+//	rate_limits:
+//	- actions:
+//	  - request_headers: {header_name: x-user-id, descriptor_key: user}
+//	  - generic_key: {descriptor_key: endpoint, descriptor_value: /v1/images}
+//
+// A route key like that is stable. If the endpoint entry comes from :path
+// instead, its query string is dropped, so /v1/images?x=1 gets /v1/images's
+// plan and counters rather than a fresh counter on DefaultPlan.
+//
+// Its windows are the same counters the middleware and the sidecar use for
+// that user and endpoint, so limits enforced at the proxy and in a service
+// share one budget.
+//
+// A descriptor with a limit override (set in Envoy from dynamic metadata)
+// is limited by that instead of its plan, as Envoy's reference service
+// does, on a counter of its own named after the override's unit.
+type RLSConfig struct {
+	// Domain is the rate limit service domain Envoy is configured with.
+	// Requests for other domains aren't limited.
+	Domain string
+	// UserKey and EndpointKey are the descriptor entry keys; they default to
+	// "user" and "endpoint".
+	UserKey     string
+	EndpointKey string
+	// Plans are the windows per endpoint; endpoints not listed get
+	// DefaultPlan, and aren't limited if that's empty too.
+	Plans       map[string][]WindowLimit
+	DefaultPlan []WindowLimit
+}
+
+// rlsServer implements envoy.service.ratelimit.v3.RateLimitService on the
+// windows script. Envoy decides what a failed call means (failure_mode_deny),
+// so a backend error is returned as Unavailable rather than guessed at here.
+type rlsServer struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	rdb redis.UniversalClient
+	cfg RLSConfig
+}
+
+func newRLSServer(rdb redis.UniversalClient, cfg RLSConfig) *rlsServer {
+	if cfg.UserKey == "" {
+		cfg.UserKey = "user"
+	}
+	if cfg.EndpointKey == "" {
+		cfg.EndpointKey = "endpoint"
+	}
+	return &rlsServer{rdb: rdb, cfg: cfg}
+}
+
+// ShouldRateLimit checks each descriptor on its own, as Envoy's reference
+// service does: a request over the limit on one descriptor has still been
+// counted against the others.
+func (s *rlsServer) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	if req.GetDomain() != s.cfg.Domain {
+		for range req.GetDescriptors() {
+			resp.Statuses = append(resp.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK})
+		}
+		return resp, nil
+	}
+
+	var retryAfter time.Duration
+	for _, desc := range req.GetDescriptors() {
+		hits := int64(max(req.GetHitsAddend(), 1))
+		if desc.GetHitsAddend() != nil {
+			hits = int64(desc.GetHitsAddend().GetValue())
+		}
+		st, err := s.check(ctx, desc, hits)
+		if err != nil {
+			log.Printf("rate limit check failed: %v", err)
+			return nil, status.Error(codes.Unavailable, "rate limit check failed")
+		}
+		if st.Code == rlsv3.RateLimitResponse_OVER_LIMIT {
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			retryAfter = max(retryAfter, st.GetDurationUntilReset().AsDuration())
+		}
+		resp.Statuses = append(resp.Statuses, st)
+	}
+	if resp.OverallCode == rlsv3.RateLimitResponse_OVER_LIMIT {
+		resp.ResponseHeadersToAdd = []*corev3.HeaderValue{
+			{Key: "Retry-After", Value: strconv.FormatInt(ceilSeconds(retryAfter), 10)},
+		}
+	}
+	return resp, nil
+}
+
+// check runs one descriptor through its plan. The status describes the
+// window with the least room left.
+func (s *rlsServer) check(ctx context.Context, desc *ratelimitv3.RateLimitDescriptor, hits int64) (*rlsv3.RateLimitResponse_DescriptorStatus, error) {
+	var userID, endpointID string
+	for _, e := range desc.GetEntries() {
+		switch e.GetKey() {
+		case s.cfg.UserKey:
+			userID = e.GetValue()
+		case s.cfg.EndpointKey:
+			endpointID, _, _ = strings.Cut(e.GetValue(), "?")
+		}
+	}
+	plan, ok := s.cfg.Plans[endpointID]
+	if !ok {
+		plan = s.cfg.DefaultPlan
+	}
+	if o := desc.GetLimit(); o != nil {
+		if period, ok := rlsOverridePeriod(o.GetUnit()); ok {
+			plan = []WindowLimit{{
+				Name:   "override_" + strings.ToLower(o.GetUnit().String()),
+				Limit:  int64(o.GetRequestsPerUnit()),
+				Period: period,
+			}}
+		}
+	}
+	if userID == "" || endpointID == "" || len(plan) == 0 {
+		return &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}, nil
+	}
+
+	d, windows, err := updateLimiterState10(ctx, s.rdb, userID, endpointID, plan, hits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check %s on %s: %w", userID, endpointID, err)
+	}
+	st := &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code:               rlsv3.RateLimitResponse_OK,
+		LimitRemaining:     uint32(min(d.Remaining, math.MaxUint32)),
+		DurationUntilReset: durationpb.New(d.ResetAfter),
+	}
+	if !d.Allowed {
+		st.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+	}
+	for i, w := range windows {
+		if w.Remaining == d.Remaining && w.Limit == d.Limit {
+			st.CurrentLimit = &rlsv3.RateLimitResponse_RateLimit{
+				Name:            w.Name,
+				RequestsPerUnit: uint32(min(w.Limit, math.MaxUint32)),
+				Unit:            rlsUnit(plan[i].Period),
+			}
+			break
+		}
+	}
+	return st, nil
+}
+
+// rlsUnit is the protocol's unit for period. Periods that aren't exactly one
+// of them, like three hours, are UNKNOWN; the limit's name still says which
+// window it is.
+func rlsUnit(period time.Duration) rlsv3.RateLimitResponse_RateLimit_Unit {
+	switch period {
+	case time.Second:
+		return rlsv3.RateLimitResponse_RateLimit_SECOND
+	case time.Minute:
+		return rlsv3.RateLimitResponse_RateLimit_MINUTE
+	case time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_HOUR
+	case 24 * time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_DAY
+	case 7 * 24 * time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_WEEK
+	}
+	return rlsv3.RateLimitResponse_RateLimit_UNKNOWN
+}
+
+// rlsOverridePeriod is how long unit is, with Envoy's reference service's
+// lengths for a month and a year. An override with an unknown unit is
+// ignored.
+func rlsOverridePeriod(unit typev3.RateLimitUnit) (time.Duration, bool) {
+	switch unit {
+	case typev3.RateLimitUnit_SECOND:
+		return time.Second, true
+	case typev3.RateLimitUnit_MINUTE:
+		return time.Minute, true
+	case typev3.RateLimitUnit_HOUR:
+		return time.Hour, true
+	case typev3.RateLimitUnit_DAY:
+		return 24 * time.Hour, true
+	case typev3.RateLimitUnit_MONTH:
+		return 30 * 24 * time.Hour, true
+	case typev3.RateLimitUnit_YEAR:
+		return 365 * 24 * time.Hour, true
+	}
+	return 0, false
+}
+
+// main36 serves the RLS protocol over an in-process bufconn listener on a
+// Redis stand-in and calls it as Envoy would: POST /v1/images is limited to
+// 3 per minute and 5 per 3 hours, everything else to 100 per minute. It
+// prints the overall code and each descriptor's status for a run through
+// the minute window, a request weighted with hits_addend, a descriptor
+// missing its user, another domain, a request with two descriptors, a path
+// with a query string, and a descriptor overriding its limit.
+func main36() {
+	server, err := startStandinRedis()
+	if err != nil {
+		log.Fatalf("failed to start stand-in: %v", err)
+	}
+	defer server.Close()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+	defer rdb.Close()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(srv, newRLSServer(rdb, RLSConfig{
+		Domain: "edge",
+		Plans: map[string][]WindowLimit{
+			"/v1/images": {
+				{Name: "minute", Limit: 3, Period: time.Minute},
+				{Name: "3hours", Limit: 5, Period: 3 * time.Hour},
+			},
+		},
+		DefaultPlan: []WindowLimit{{Name: "minute", Limit: 100, Period: time.Minute}},
+	}))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := rlsv3.NewRateLimitServiceClient(conn)
+
+	descriptor := func(entries ...string) *ratelimitv3.RateLimitDescriptor {
+		d := &ratelimitv3.RateLimitDescriptor{}
+		for i := 0; i+1 < len(entries); i += 2 {
+			d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+		}
+		return d
+	}
+	call := func(label string, req *rlsv3.RateLimitRequest) {
+		resp, err := client.ShouldRateLimit(context.Background(), req)
+		if err != nil {
+			fmt.Printf("%s: %v\n", label, err)
+			return
+		}
+		fmt.Printf("%s: %v", label, resp.GetOverallCode())
+		for _, h := range resp.GetResponseHeadersToAdd() {
+			fmt.Printf(" %s=%s", h.GetKey(), h.GetValue())
+		}
+		fmt.Println()
+		for _, st := range resp.GetStatuses() {
+			fmt.Printf("    %v", st.GetCode())
+			if l := st.GetCurrentLimit(); l != nil {
+				fmt.Printf(" %s %d/%v remaining=%d reset in %v",
+					l.GetName(), l.GetRequestsPerUnit(), l.GetUnit(), st.GetLimitRemaining(), st.GetDurationUntilReset().AsDuration().Round(time.Second))
+			}
+			fmt.Println()
+		}
+	}
+
+	images := descriptor("user", "customer123", "endpoint", "/v1/images")
+	fmt.Println("=== 4 requests against 3 per minute ===")
+	for i := 0; i < 4; i++ {
+		call(fmt.Sprintf("%d", i+1), &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{images}})
+	}
+
+	fmt.Println("\n=== Other cases ===")
+	call("hits_addend 10 on the default plan", &rlsv3.RateLimitRequest{Domain: "edge", HitsAddend: 10,
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("user", "customer456", "endpoint", "/v1/models")}})
+	call("no user", &rlsv3.RateLimitRequest{Domain: "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("endpoint", "/v1/images")}})
+	call("other domain", &rlsv3.RateLimitRequest{Domain: "internal", Descriptors: []*ratelimitv3.RateLimitDescriptor{images}})
+	call("two descriptors, one over", &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{
+		descriptor("user", "customer456", "endpoint", "/v1/models"),
+		images,
+	}})
+	call("query string on the path", &rlsv3.RateLimitRequest{Domain: "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("user", "customer123", "endpoint", "/v1/images?x=1")}})
+	overridden := descriptor("user", "customer123", "endpoint", "/v1/images")
+	overridden.Limit = &ratelimitv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 50, Unit: typev3.RateLimitUnit_HOUR}
+	call("override 50 per hour", &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{overridden}})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+)
+
+// lagReport is the structured result of a read-your-writes run, written as
+// JSON so runs can be compared and plotted.
+type lagReport struct {
+	Benchmark    string    `json:"benchmark"`
+	Target       string    `json:"target"` // "meter:<slug>" or "entitlement:<feature>"
+	BaseURL      string    `json:"base_url,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	Trials       int       `json:"trials"`
+	Observed     int       `json:"observed"`
+	TimedOut     int       `json:"timed_out"`
+	PollInterval float64   `json:"poll_interval_ms"`
+	LagP50       float64   `json:"lag_p50_ms"`
+	LagP95       float64   `json:"lag_p95_ms"`
+	LagMax       float64   `json:"lag_max_ms"`
+	Lags         []float64 `json:"lags_ms,omitempty"`
+}
+
+func millis(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func (r lagReport) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// lagProbe logs one tagged event and reports whether its usage is visible.
+type lagProbe struct {
+	target string
+	// write logs the trial's event; visible then reports whether a read
+	// reflects it
+	write   func(ctx context.Context, trial int) error
+	visible func(ctx context.Context, trial int) (bool, error)
+}
+
+// meterLagProbe tags each trial's event with a subject of its own, so the
+// meter has nothing for that subject until the event shows up.
+func meterLagProbe(svc *ImageGenService, meterSlug string) lagProbe {
+	run := uuid.NewString()[:8]
+	subject := func(trial int) string { return fmt.Sprintf("rw-lag-%s-%d", run, trial) }
+	return lagProbe{
+		target: "meter:" + meterSlug,
+		write: func(ctx context.Context, trial int) error {
+			_, err := svc.LogUsage(ctx, UsageEvent{
+				Subject: subject(trial),
+				Type:    "text2media",
+				Values:  map[string]float64{"gpu_time": 1, "outputs": 1},
+			})
+			return err
+		},
+		visible: func(ctx context.Context, trial int) (bool, error) {
+			subjects := []string{subject(trial)}
+			resp, err := svc.client.QueryMeterWithResponse(ctx, meterSlug, &openmeter.QueryMeterParams{Subject: &subjects})
+			if err != nil {
+				return false, fmt.Errorf("failed to query meter: %w", err)
+			}
+			if resp.JSON200 == nil {
+				return false, openMeterError("query meter "+meterSlug, resp.StatusCode(), resp.Body)
+			}
+			for _, row := range resp.JSON200.Data {
+				if row.Value > 0 {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+	}
+}
+
+// entitlementLagProbe reads the subject's usage before each trial and waits
+// for it to grow by the trial's GPU time. Entitlements belong to a
+// provisioned subject, so trials can't each have their own; they run one at
+// a time instead, and the amount is odd enough not to be mistaken for
+// anyone else's usage arriving.
+func entitlementLagProbe(svc *ImageGenService, subject string, feature string) lagProbe {
+	const amount = 0.125
+	var baseline float64
+	return lagProbe{
+		target: "entitlement:" + feature,
+		write: func(ctx context.Context, trial int) error {
+			// Straight to OpenMeter, never through the cache
+			ent, err := svc.entitlement(ctx, subject, feature)
+			if err != nil {
+				return err
+			}
+			baseline = ent.Usage
+			_, err = svc.LogUsage(ctx, UsageEvent{
+				Subject: subject,
+				Type:    "text2media",
+				Values:  map[string]float64{"gpu_time": amount, "outputs": 0},
+			})
+			return err
+		},
+		visible: func(ctx context.Context, trial int) (bool, error) {
+			ent, err := svc.entitlement(ctx, subject, feature)
+			if err != nil {
+				return false, err
+			}
+			return ent.Usage >= baseline+amount, nil
+		},
+	}
+}
+
+// measureReadYourWrites runs trials one after another: write a tagged event,
+// then poll until a read reflects it or timeout passes. A trial's lag runs
+// from just before the write to the first read that saw it, so it is only
+// as fine as pollInterval.
+func measureReadYourWrites(ctx context.Context, probe lagProbe, trials int, pollInterval time.Duration, timeout time.Duration) (lagReport, error) {
+	report := lagReport{
+		Benchmark:    "read-your-writes",
+		Target:       probe.target,
+		StartedAt:    time.Now().UTC(),
+		Trials:       trials,
+		PollInterval: millis(pollInterval),
+	}
+	var lags []time.Duration
+	for trial := 0; trial < trials; trial++ {
+		start := time.Now()
+		if err := probe.write(ctx, trial); err != nil {
+			return report, fmt.Errorf("trial %d: %w", trial, err)
+		}
+		seen := false
+		for !seen && time.Since(start) < timeout {
+			var err error
+			if seen, err = probe.visible(ctx, trial); err != nil {
+				return report, fmt.Errorf("trial %d: %w", trial, err)
+			}
+			if !seen {
+				time.Sleep(pollInterval)
+			}
+		}
+		if !seen {
+			report.TimedOut++
+			continue
+		}
+		lag := time.Since(start)
+		lags = append(lags, lag)
+		report.Lags = append(report.Lags, millis(lag))
+	}
+	report.Observed = len(lags)
+	if len(lags) > 0 {
+		report.LagP50 = millis(percentile(lags, 0.50))
+		report.LagP95 = millis(percentile(lags, 0.95))
+		report.LagMax = millis(lags[len(lags)-1])
+	}
+	return report, nil
+}
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+// main30 measures read-your-writes lag against OPENMETER_URL: RW_TRIALS
+// trials (default 20) on the RW_TARGET meter slug, or on the gputimecheck
+// entitlement if RW_TARGET is "entitlement". The report goes to stdout and,
+// if REPORT_FILE is set, to that file.
+func main30() {
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Warning: Error loading .env file: %v", err)
+	}
+	cfg := openMeterConfigFromEnv()
+	svc, err := NewImageGenServiceWithConfig(cfg)
+	if err != nil {
+		log.Fatalf("failed to create service: %v", err)
+	}
+
+	probe := meterLagProbe(svc, "gpu_time")
+	switch target := os.Getenv("RW_TARGET"); target {
+	case "", "gpu_time":
+	case "entitlement":
+		probe = entitlementLagProbe(svc, "customer123", "gputimecheck")
+	default:
+		probe = meterLagProbe(svc, target)
+	}
+
+	report, err := measureReadYourWrites(context.Background(), probe, envInt("RW_TRIALS", 20), 250*time.Millisecond, 2*time.Minute)
+	if err != nil {
+		log.Fatalf("measurement failed: %v", err)
+	}
+	report.BaseURL = cfg.BaseURL
+	if err := report.write(os.Stdout); err != nil {
+		log.Fatalf("failed to write report: %v", err)
+	}
+	if path := os.Getenv("REPORT_FILE"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("failed to write report: %v", err)
+		}
+		defer f.Close()
+		if err := report.write(f); err != nil {
+			log.Fatalf("failed to write report: %v", err)
+		}
+	}
+}
+
+// main31 runs the measurement against the simulator, with ingest taking
+// 150-250ms to show up, on both the meter and the entitlement.
+func main31() {
+	ctx := context.Background()
+	om := startStandinOpenMeter()
+	defer om.Close()
+	client, err := newOpenMeterClient(OpenMeterConfig{BaseURL: om.URL(), APIKey: "test-token"})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := provision(ctx, client, defaultProvisioningSpec, true, io.Discard); err != nil {
+		log.Fatalf("provisioning failed: %v", err)
+	}
+	om.setIngestLag(150 * time.Millisecond)
+	om.setIngestJitter(100 * time.Millisecond)
+
+	svc := &ImageGenService{client: client, feature: "gputimecheck", subject: "customer123"}
+	for _, probe := range []lagProbe{
+		meterLagProbe(svc, "gpu_time"),
+		entitlementLagProbe(svc, "customer123", "gputimecheck"),
+	} {
+		report, err := measureReadYourWrites(ctx, probe, 20, 10*time.Millisecond, 5*time.Second)
+		if err != nil {
+			log.Fatalf("measurement failed: %v", err)
+		}
+		report.Lags = nil
+		if err := report.write(os.Stdout); err != nil {
+			log.Fatalf("failed to write report: %v", err)
+		}
+	}
+}
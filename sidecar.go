@@ -0,0 +1,736 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// The sidecar serves the limiter to services that can't link it in, over
+// HTTP/JSON and gRPC:
+//
+//	Allow    admit tokens' worth of work; the lease it returns holds any
+//	         concurrency slot until Release
+//	Release  give back a lease's slots
+//	Reserve  like Allow, for work whose cost is only an estimate
+//	Commit   settle a lease at what the work actually cost, giving back the
+//	         difference (or taking more), and release its slots
+//
+// A lease nobody releases or commits lapses after its TTL, keeping what it
+// took.
+
+var (
+	errLeaseNotFound = errors.New("lease not found")
+	errBadRequest    = errors.New("bad request")
+)
+
+type allowRequest struct {
+	UserID     string `json:"user_id"`
+	EndpointID string `json:"endpoint_id"`
+	Tokens     int64  `json:"tokens"`
+}
+
+type reserveRequest struct {
+	UserID     string `json:"user_id"`
+	EndpointID string `json:"endpoint_id"`
+	Tokens     int64  `json:"tokens"`
+	// TTLMillis is how long the reservation stands uncommitted; zero means
+	// the sidecar's lease TTL, which is also the most it can be, since the
+	// lease's concurrency slot lapses then
+	TTLMillis int64 `json:"ttl_ms"`
+}
+
+type releaseRequest struct {
+	LeaseID string `json:"lease_id"`
+}
+
+type releaseReply struct {
+	Released bool `json:"released"`
+}
+
+type commitRequest struct {
+	LeaseID string `json:"lease_id"`
+	// Tokens is what the work actually cost
+	Tokens int64 `json:"tokens"`
+}
+
+// decisionReply is a Decision as the sidecar's clients see it: milliseconds
+// rather than a Go duration, and the sidecar's lease rather than a limiter's.
+type decisionReply struct {
+	Allowed          bool   `json:"allowed"`
+	Limit            int64  `json:"limit"`
+	Remaining        int64  `json:"remaining"`
+	ResetAfterMillis int64  `json:"reset_after_ms"`
+	LeaseID          string `json:"lease_id,omitempty"`
+}
+
+func newDecisionReply(d Decision) decisionReply {
+	return decisionReply{
+		Allowed:          d.Allowed,
+		Limit:            d.Limit,
+		Remaining:        d.Remaining,
+		ResetAfterMillis: d.ResetAfter.Milliseconds(),
+	}
+}
+
+// sidecarLease is what an allowed request holds until it's released,
+// committed or lapses.
+type sidecarLease struct {
+	userID     string
+	endpointID string
+	tokens     int64
+	// admitted is when the tokens were taken, for Commit's adjustment
+	admitted time.Time
+	expires  time.Time
+	release  func()
+
+	// settled is how many limiters a Commit that then failed had adjusted
+	// to committed tokens, so a retry carries on from the next one, and
+	// tightest is what they reported
+	settled   int
+	committed int64
+	tightest  Decision
+}
+
+type sidecar struct {
+	limiters []Limiter
+	leaseTTL time.Duration
+
+	mu     sync.Mutex
+	leases map[string]*sidecarLease
+
+	// draining is set once shutdown starts, so readiness fails while
+	// requests in flight finish
+	draining atomic.Bool
+	ping     func(ctx context.Context) error
+	// rls, if set, is served on the gRPC server too, for Envoy
+	rls *rlsServer
+}
+
+func newSidecar(limiters []Limiter, leaseTTL time.Duration) *sidecar {
+	return &sidecar{limiters: limiters, leaseTTL: leaseTTL, leases: make(map[string]*sidecarLease)}
+}
+
+func (s *sidecar) admit(ctx context.Context, userID string, endpointID string, tokens int64, ttl time.Duration) (decisionReply, error) {
+	if userID == "" || endpointID == "" || tokens < 0 {
+		return decisionReply{}, fmt.Errorf("%w: need user_id, endpoint_id and tokens >= 0", errBadRequest)
+	}
+	d, release, err := admit(ctx, s.limiters, userID, endpointID, tokens, false)
+	if err != nil {
+		return decisionReply{}, err
+	}
+	reply := newDecisionReply(d)
+	if !d.Allowed {
+		return reply, nil
+	}
+	now := time.Now()
+	reply.LeaseID = uuid.NewString()
+	s.mu.Lock()
+	s.leases[reply.LeaseID] = &sidecarLease{
+		userID:     userID,
+		endpointID: endpointID,
+		tokens:     tokens,
+		admitted:   now,
+		expires:    now.Add(ttl),
+		release:    release,
+	}
+	s.mu.Unlock()
+	return reply, nil
+}
+
+func (s *sidecar) Allow(ctx context.Context, req allowRequest) (decisionReply, error) {
+	return s.admit(ctx, req.UserID, req.EndpointID, req.Tokens, s.leaseTTL)
+}
+
+func (s *sidecar) Reserve(ctx context.Context, req reserveRequest) (decisionReply, error) {
+	ttl := s.leaseTTL
+	if req.TTLMillis > 0 {
+		ttl = min(time.Duration(req.TTLMillis)*time.Millisecond, s.leaseTTL)
+	}
+	return s.admit(ctx, req.UserID, req.EndpointID, req.Tokens, ttl)
+}
+
+func (s *sidecar) take(leaseID string) *sidecarLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.leases[leaseID]
+	delete(s.leases, leaseID)
+	return l
+}
+
+func (s *sidecar) Release(ctx context.Context, req releaseRequest) (releaseReply, error) {
+	l := s.take(req.LeaseID)
+	if l == nil {
+		return releaseReply{}, fmt.Errorf("%w: %s", errLeaseNotFound, req.LeaseID)
+	}
+	l.release()
+	return releaseReply{Released: true}, nil
+}
+
+// Commit settles a lease at req.Tokens. Limiters that can't adjust what they
+// counted keep what the lease took. The reply describes the tightest limit
+// after the adjustment; Allowed is false if the extra cost took it over.
+//
+// The lease is only released once every limiter is adjusted. If one fails,
+// the lease is put back, remembering the limiters already adjusted, so
+// retrying the Commit finishes the job without adjusting any of them twice.
+func (s *sidecar) Commit(ctx context.Context, req commitRequest) (decisionReply, error) {
+	if req.Tokens < 0 {
+		return decisionReply{}, fmt.Errorf("%w: need tokens >= 0", errBadRequest)
+	}
+	l := s.take(req.LeaseID)
+	if l == nil {
+		return decisionReply{}, fmt.Errorf("%w: %s", errLeaseNotFound, req.LeaseID)
+	}
+	if l.settled == 0 {
+		l.committed = req.Tokens
+		l.tightest = Decision{Allowed: true, Remaining: -1}
+	} else if req.Tokens != l.committed {
+		s.putBack(req.LeaseID, l)
+		return decisionReply{}, fmt.Errorf("%w: lease is partly committed at %d tokens", errBadRequest, l.committed)
+	}
+
+	delta := l.committed - l.tokens
+	age := time.Since(l.admitted)
+	for ; delta != 0 && l.settled < len(s.limiters); l.settled++ {
+		a, ok := s.limiters[l.settled].(adjuster)
+		if !ok {
+			continue
+		}
+		d, err := a.Adjust(ctx, l.userID, l.endpointID, delta, age)
+		if err != nil {
+			s.putBack(req.LeaseID, l)
+			return decisionReply{}, err
+		}
+		if !d.Allowed {
+			l.tightest.Allowed = false
+		}
+		if d.Remaining >= 0 && (l.tightest.Remaining < 0 || d.Remaining < l.tightest.Remaining) {
+			l.tightest.Limit, l.tightest.Remaining, l.tightest.ResetAfter = d.Limit, d.Remaining, d.ResetAfter
+		}
+	}
+	l.release()
+	return newDecisionReply(l.tightest), nil
+}
+
+// putBack returns a lease taken by a Commit that failed.
+func (s *sidecar) putBack(leaseID string, l *sidecarLease) {
+	s.mu.Lock()
+	s.leases[leaseID] = l
+	s.mu.Unlock()
+}
+
+// expire releases the slots of leases past their TTL.
+func (s *sidecar) expire(now time.Time) int {
+	s.mu.Lock()
+	var lapsed []*sidecarLease
+	for id, l := range s.leases {
+		if now.After(l.expires) {
+			lapsed = append(lapsed, l)
+			delete(s.leases, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, l := range lapsed {
+		l.release()
+	}
+	return len(lapsed)
+}
+
+// releaseAll gives back every lease's slots, for shutdown.
+func (s *sidecar) releaseAll() int {
+	s.mu.Lock()
+	leases := s.leases
+	s.leases = make(map[string]*sidecarLease)
+	s.mu.Unlock()
+	for _, l := range leases {
+		l.release()
+	}
+	return len(leases)
+}
+
+// ready reports whether the sidecar should get traffic: it isn't shutting
+// down and its backend answers.
+func (s *sidecar) ready(ctx context.Context) error {
+	if s.draining.Load() {
+		return errors.New("shutting down")
+	}
+	if s.ping != nil {
+		if err := s.ping(ctx); err != nil {
+			return fmt.Errorf("backend unavailable: %w", err)
+		}
+	}
+	return nil
+}
+
+// sidecarHandler is the HTTP/JSON API: POST /v1/allow, /v1/reserve,
+// /v1/release and /v1/commit, plus GET /healthz (the process is up) and
+// GET /readyz (it should get traffic).
+func sidecarHandler(s *sidecar) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/allow", sidecarRoute(s.Allow))
+	mux.HandleFunc("POST /v1/reserve", sidecarRoute(s.Reserve))
+	mux.HandleFunc("POST /v1/release", sidecarRoute(s.Release))
+	mux.HandleFunc("POST /v1/commit", sidecarRoute(s.Commit))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.ready(r.Context()); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	})
+	return mux
+}
+
+func sidecarRoute[Req any, Reply any](call func(context.Context, Req) (Reply, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON: " + err.Error()})
+			return
+		}
+		reply, err := call(r.Context(), req)
+		switch {
+		case err == nil:
+			writeJSON(w, http.StatusOK, reply)
+		case errors.Is(err, errBadRequest):
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case errors.Is(err, errLeaseNotFound):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		default:
+			log.Printf("%s failed: %v", r.URL.Path, err)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "limiter unavailable"})
+		}
+	}
+}
+
+// SidecarConfig is how the daemon is set up, read from the environment by
+// sidecarConfigFromEnv.
+type SidecarConfig struct {
+	HTTPAddr string // HTTP_ADDR, default :8080
+	GRPCAddr string // GRPC_ADDR, default :9090
+	// Strategy is LIMITER_STRATEGY: "windows" (the default) checks every
+	// window of Plan in one script call; "leased" and "two-tier" put leases
+	// or local counters in front of Redis and take a Plan of one window
+	Strategy string
+	// Plan is PLAN, such as "minute=100/1m,day=500/24h"
+	Plan []WindowLimit
+	// Concurrency is CONCURRENCY, in-flight leases per user and endpoint;
+	// zero means no limit
+	Concurrency int64
+	// LeaseTTL is LEASE_TTL, default 1m
+	LeaseTTL time.Duration
+	// RLSDomain is RLS_DOMAIN. When it's set, the gRPC server also serves
+	// Envoy's rate limit service for that domain (see RLSConfig), with Plan
+	// for endpoints EndpointPlans doesn't list. It always uses the windows
+	// script, whatever Strategy is.
+	RLSDomain string
+	// EndpointPlans is ENDPOINT_PLANS, the rate limit service's plans for
+	// particular endpoints, such as
+	// "/v1/images:minute=3/1m,3hours=5/3h;/v1/models:minute=10/1m"
+	EndpointPlans map[string][]WindowLimit
+	// ShutdownTimeout is how long requests in flight get to finish
+	ShutdownTimeout time.Duration
+}
+
+var defaultSidecarPlan = []WindowLimit{
+	{Name: "minute", Limit: 100, Period: time.Minute},
+	{Name: "3hours", Limit: 300, Period: 3 * time.Hour},
+	{Name: "day", Limit: 500, Period: 24 * time.Hour},
+}
+
+// parsePlan reads name=limit/period windows separated by commas.
+func parsePlan(s string) ([]WindowLimit, error) {
+	var plan []WindowLimit
+	for _, part := range strings.Split(s, ",") {
+		name, rest, ok1 := strings.Cut(strings.TrimSpace(part), "=")
+		limit, period, ok2 := strings.Cut(rest, "/")
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("window %q is not name=limit/period", part)
+		}
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("window %q: %w", part, err)
+		}
+		d, err := time.ParseDuration(period)
+		if err != nil {
+			return nil, fmt.Errorf("window %q: %w", part, err)
+		}
+		plan = append(plan, WindowLimit{Name: name, Limit: n, Period: d})
+	}
+	return plan, nil
+}
+
+func sidecarConfigFromEnv() (SidecarConfig, error) {
+	cfg := SidecarConfig{
+		HTTPAddr:        ":8080",
+		GRPCAddr:        ":9090",
+		Strategy:        os.Getenv("LIMITER_STRATEGY"),
+		RLSDomain:       os.Getenv("RLS_DOMAIN"),
+		Plan:            defaultSidecarPlan,
+		Concurrency:     int64(envInt("CONCURRENCY", 0)),
+		LeaseTTL:        time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+	}
+	if v := os.Getenv("HTTP_ADDR"); v != "" {
+		cfg.HTTPAddr = v
+	}
+	if v := os.Getenv("GRPC_ADDR"); v != "" {
+		cfg.GRPCAddr = v
+	}
+	if v := os.Getenv("PLAN"); v != "" {
+		plan, err := parsePlan(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid PLAN: %w", err)
+		}
+		cfg.Plan = plan
+	}
+	if v := os.Getenv("ENDPOINT_PLANS"); v != "" {
+		cfg.EndpointPlans = make(map[string][]WindowLimit)
+		for _, part := range strings.Split(v, ";") {
+			// Endpoints may have a colon in them; plans don't
+			i := strings.LastIndex(part, ":")
+			if i < 0 {
+				return cfg, fmt.Errorf("invalid ENDPOINT_PLANS: %q is not endpoint:plan", part)
+			}
+			plan, err := parsePlan(part[i+1:])
+			if err != nil {
+				return cfg, fmt.Errorf("invalid ENDPOINT_PLANS: %w", err)
+			}
+			cfg.EndpointPlans[strings.TrimSpace(part[:i])] = plan
+		}
+	}
+	if v := os.Getenv("LEASE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid LEASE_TTL: %w", err)
+		}
+		cfg.LeaseTTL = d
+	}
+	return cfg, cfg.validate()
+}
+
+// validate checks that cfg's strategy can enforce its whole plan.
+func (cfg SidecarConfig) validate() error {
+	if len(cfg.Plan) == 0 {
+		return errors.New("plan has no windows")
+	}
+	switch cfg.Strategy {
+	case "", "windows":
+	case "leased", "two-tier":
+		if len(cfg.Plan) > 1 {
+			return fmt.Errorf("strategy %q enforces one window, but the plan has %d; set PLAN to one window", cfg.Strategy, len(cfg.Plan))
+		}
+	default:
+		return fmt.Errorf("unknown strategy %q", cfg.Strategy)
+	}
+	return nil
+}
+
+// sidecarLimiters builds cfg's limiters on rdb, concurrency first so a
+// denial by the plan gives its slot straight back. shutdown stops whatever
+// the strategy runs in the background.
+func sidecarLimiters(ctx context.Context, rdb redis.UniversalClient, cfg SidecarConfig) (limiters []Limiter, shutdown func(context.Context) error, err error) {
+	shutdown = func(context.Context) error { return nil }
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Concurrency > 0 {
+		fns, err := loadLimiterFunctions(ctx, rdb)
+		if err != nil {
+			return nil, nil, err
+		}
+		limiters = append(limiters, newConcurrencyLimiter(fns, cfg.Concurrency, cfg.LeaseTTL))
+	}
+	first := cfg.Plan[0]
+	switch cfg.Strategy {
+	case "", "windows":
+		limiters = append(limiters, newWindowLimiter(rdb, cfg.Plan))
+	case "leased":
+		l := newLeasingLimiter(redisLeaseStore{rdb: rdb}, LeasePlan{
+			Limit:     first.Limit,
+			BlockSize: max(first.Limit/100, 1),
+			LeaseTTL:  time.Second,
+			Window:    first.Period,
+		})
+		limiters = append(limiters, l)
+		shutdown = l.Close
+	case "two-tier":
+		l := newTwoTierLimiter(redisTotalsStore{rdb: rdb}, first.Limit, first.Period, time.Second)
+		limiters = append(limiters, l)
+		shutdown = l.Close
+	}
+	return limiters, shutdown, nil
+}
+
+// rlsConfig is the rate limit service's configuration in cfg.
+func (cfg SidecarConfig) rlsConfig() RLSConfig {
+	return RLSConfig{Domain: cfg.RLSDomain, Plans: cfg.EndpointPlans, DefaultPlan: cfg.Plan}
+}
+
+// runSidecar serves s on the given listeners until ctx is done, then shuts
+// down: readiness and the gRPC health service report not serving, both
+// servers stop taking new requests and finish the ones in flight (for up to
+// timeout), and leases still held are released.
+func runSidecar(ctx context.Context, s *sidecar, httpLis net.Listener, grpcLis net.Listener, timeout time.Duration) error {
+	httpSrv := &http.Server{Handler: sidecarHandler(s)}
+	grpcSrv := grpc.NewServer()
+	registerSidecarServer(grpcSrv, s)
+	healthSrv := health.NewServer()
+	healthpb.RegisterHealthServer(grpcSrv, healthSrv)
+	healthSrv.SetServingStatus(sidecarServiceName, healthpb.HealthCheckResponse_SERVING)
+	if s.rls != nil {
+		rlsv3.RegisterRateLimitServiceServer(grpcSrv, s.rls)
+		healthSrv.SetServingStatus(rlsv3.RateLimitService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		if err := httpSrv.Serve(httpLis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errs <- fmt.Errorf("HTTP server failed: %w", err)
+		}
+	}()
+	go func() {
+		if err := grpcSrv.Serve(grpcLis); err != nil {
+			errs <- fmt.Errorf("gRPC server failed: %w", err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.expire(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-errs:
+	}
+
+	s.draining.Store(true)
+	healthSrv.Shutdown()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := httpSrv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		grpcSrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		grpcSrv.Stop()
+	}
+	if n := s.releaseAll(); n > 0 {
+		log.Printf("released %d leases still held at shutdown", n)
+	}
+	return serveErr
+}
+
+// main34 runs the sidecar on the Redis at REDIS_ADDRS until SIGINT or
+// SIGTERM. See SidecarConfig for the rest of its settings.
+func main34() {
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Warning: Error loading .env file: %v", err)
+	}
+	cfg, err := sidecarConfigFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rdb := newRedisClient()
+	defer rdb.Close()
+	limiters, closeLimiters, err := sidecarLimiters(ctx, rdb, cfg)
+	if err != nil {
+		log.Fatalf("failed to set up limiters: %v", err)
+	}
+	s := newSidecar(limiters, cfg.LeaseTTL)
+	s.ping = func(ctx context.Context) error { return rdb.Ping(ctx).Err() }
+	if cfg.RLSDomain != "" {
+		s.rls = newRLSServer(rdb, cfg.rlsConfig())
+	}
+
+	httpLis, err := net.Listen("tcp", cfg.HTTPAddr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	grpcLis, err := net.Listen("tcp", cfg.GRPCAddr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	log.Printf("sidecar serving HTTP on %s and gRPC on %s", httpLis.Addr(), grpcLis.Addr())
+	if err := runSidecar(ctx, s, httpLis, grpcLis, cfg.ShutdownTimeout); err != nil {
+		log.Printf("%v", err)
+	}
+	if err := closeLimiters(context.Background()); err != nil {
+		log.Printf("failed to close limiters: %v", err)
+	}
+}
+
+// main35 runs the sidecar in-process on a Redis stand-in, with a plan of 10
+// per minute and 2 leases at a time, HTTP on a loopback port and gRPC on a
+// bufconn listener. It goes through Allow and Release over HTTP, Reserve and
+// Commit over gRPC, the health checks, a check from Envoy sharing the same
+// window, and a shutdown with a lease still held.
+func main35() {
+	server, err := startStandinRedis()
+	if err != nil {
+		log.Fatalf("failed to start stand-in: %v", err)
+	}
+	defer server.Close()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+	defer rdb.Close()
+
+	ctx, stop := context.WithCancel(context.Background())
+	cfg := SidecarConfig{
+		Plan:        []WindowLimit{{Name: "minute", Limit: 10, Period: time.Minute}},
+		Concurrency: 2,
+		LeaseTTL:    time.Minute,
+		RLSDomain:   "edge",
+	}
+	limiters, _, err := sidecarLimiters(ctx, rdb, cfg)
+	if err != nil {
+		log.Fatalf("failed to set up limiters: %v", err)
+	}
+	s := newSidecar(limiters, cfg.LeaseTTL)
+	s.ping = func(ctx context.Context) error { return rdb.Ping(ctx).Err() }
+	s.rls = newRLSServer(rdb, cfg.rlsConfig())
+
+	httpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	grpcLis := bufconn.Listen(1 << 20)
+	done := make(chan error, 1)
+	go func() { done <- runSidecar(ctx, s, httpLis, grpcLis, 5*time.Second) }()
+
+	base := "http://" + httpLis.Addr().String()
+	post := func(path string, body any) string {
+		data, _ := json.Marshal(body)
+		resp, err := http.Post(base+path, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return err.Error()
+		}
+		defer resp.Body.Close()
+		reply, _ := io.ReadAll(resp.Body)
+		return fmt.Sprintf("%d %s", resp.StatusCode, bytes.TrimSpace(reply))
+	}
+	get := func(path string) string {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			return err.Error()
+		}
+		defer resp.Body.Close()
+		reply, _ := io.ReadAll(resp.Body)
+		return fmt.Sprintf("%d %s", resp.StatusCode, bytes.TrimSpace(reply))
+	}
+	leaseOf := func(reply string) string {
+		var d decisionReply
+		_, body, _ := strings.Cut(reply, " ")
+		json.Unmarshal([]byte(body), &d)
+		return d.LeaseID
+	}
+
+	fmt.Println("=== HTTP ===")
+	fmt.Println("readyz:", get("/readyz"))
+	req := allowRequest{UserID: "customer123", EndpointID: "image-gen", Tokens: 1}
+	first := post("/v1/allow", req)
+	fmt.Println("allow:", first)
+	fmt.Println("allow:", post("/v1/allow", req))
+	fmt.Println("allow (2 held):", post("/v1/allow", req))
+	fmt.Println("release:", post("/v1/release", releaseRequest{LeaseID: leaseOf(first)}))
+	fmt.Println("release again:", post("/v1/release", releaseRequest{LeaseID: leaseOf(first)}))
+	fmt.Println("allow:", post("/v1/allow", req))
+	fmt.Println("no user:", post("/v1/allow", allowRequest{EndpointID: "image-gen", Tokens: 1}))
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return grpcLis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := newSidecarClient(conn)
+
+	fmt.Println("\n=== gRPC ===")
+	health, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: sidecarServiceName})
+	fmt.Printf("health: %v %v\n", health.GetStatus(), err)
+	for _, c := range []struct{ reserved, actual int64 }{{5, 2}, {2, 6}} {
+		r, err := client.Reserve(context.Background(), reserveRequest{UserID: "customer456", EndpointID: "image-gen", Tokens: c.reserved})
+		if err != nil {
+			log.Fatalf("reserve failed: %v", err)
+		}
+		fmt.Printf("reserve %d: allowed=%v remaining=%d\n", c.reserved, r.Allowed, r.Remaining)
+		d, err := client.Commit(context.Background(), commitRequest{LeaseID: r.LeaseID, Tokens: c.actual})
+		fmt.Printf("commit %d: allowed=%v remaining=%d err=%v\n", c.actual, d.Allowed, d.Remaining, err)
+	}
+	_, err = client.Commit(context.Background(), commitRequest{LeaseID: "nope"})
+	fmt.Printf("commit unknown lease: %v\n", status.Code(err))
+
+	fmt.Println("\n=== Envoy rate limit service ===")
+	rls, err := rlsv3.NewRateLimitServiceClient(conn).ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Domain: "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{{Entries: []*ratelimitv3.RateLimitDescriptor_Entry{
+			{Key: "user", Value: "customer456"}, {Key: "endpoint", Value: "image-gen"},
+		}}},
+	})
+	if err != nil {
+		log.Fatalf("rate limit check failed: %v", err)
+	}
+	fmt.Printf("customer456 on image-gen: %v remaining=%d\n", rls.GetOverallCode(), rls.GetStatuses()[0].GetLimitRemaining())
+
+	fmt.Println("\n=== Shutdown with one lease held ===")
+	held, err := client.Allow(context.Background(), allowRequest{UserID: "customer789", EndpointID: "image-gen", Tokens: 1})
+	if err != nil || !held.Allowed {
+		log.Fatalf("allow failed: %+v %v", held, err)
+	}
+	stop()
+	if err := <-done; err != nil {
+		log.Printf("%v", err)
+	}
+	ok, _, err := limiters[0].(*concurrencyLimiter).fns.acquire(context.Background(),
+		windowKey("concurrency", "customer789", "image-gen"), "probe", 1, time.Second)
+	fmt.Printf("lease %s... released: %v %v\n", held.LeaseID[:8], ok, err)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cozy-creator/openmeter-client/sidecarpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/cozy-creator/openmeter-client --go-grpc_out=. --go-grpc_opt=module=github.com/cozy-creator/openmeter-client sidecar.proto
+
+// sidecarServiceName is the service in sidecar.proto.
+var sidecarServiceName = sidecarpb.Limiter_ServiceDesc.ServiceName
+
+// sidecarServer is the Limiter service.
+type sidecarServer interface {
+	Allow(ctx context.Context, req allowRequest) (decisionReply, error)
+	Reserve(ctx context.Context, req reserveRequest) (decisionReply, error)
+	Release(ctx context.Context, req releaseRequest) (releaseReply, error)
+	Commit(ctx context.Context, req commitRequest) (decisionReply, error)
+}
+
+// grpcSidecar serves a sidecarServer through the generated Limiter service,
+// translating between its messages and the HTTP API's.
+type grpcSidecar struct {
+	sidecarpb.UnimplementedLimiterServer
+	s sidecarServer
+}
+
+// registerSidecarServer serves s as the Limiter service.
+func registerSidecarServer(srv *grpc.Server, s sidecarServer) {
+	sidecarpb.RegisterLimiterServer(srv, grpcSidecar{s: s})
+}
+
+func (g grpcSidecar) Allow(ctx context.Context, req *sidecarpb.AllowRequest) (*sidecarpb.Decision, error) {
+	reply, err := g.s.Allow(ctx, allowRequest{UserID: req.GetUserId(), EndpointID: req.GetEndpointId(), Tokens: req.GetTokens()})
+	if err != nil {
+		return nil, sidecarStatus(err)
+	}
+	return decisionToProto(reply), nil
+}
+
+func (g grpcSidecar) Reserve(ctx context.Context, req *sidecarpb.ReserveRequest) (*sidecarpb.Decision, error) {
+	reply, err := g.s.Reserve(ctx, reserveRequest{
+		UserID:     req.GetUserId(),
+		EndpointID: req.GetEndpointId(),
+		Tokens:     req.GetTokens(),
+		TTLMillis:  req.GetTtlMs(),
+	})
+	if err != nil {
+		return nil, sidecarStatus(err)
+	}
+	return decisionToProto(reply), nil
+}
+
+func (g grpcSidecar) Release(ctx context.Context, req *sidecarpb.ReleaseRequest) (*sidecarpb.ReleaseReply, error) {
+	reply, err := g.s.Release(ctx, releaseRequest{LeaseID: req.GetLeaseId()})
+	if err != nil {
+		return nil, sidecarStatus(err)
+	}
+	return &sidecarpb.ReleaseReply{Released: reply.Released}, nil
+}
+
+func (g grpcSidecar) Commit(ctx context.Context, req *sidecarpb.CommitRequest) (*sidecarpb.Decision, error) {
+	reply, err := g.s.Commit(ctx, commitRequest{LeaseID: req.GetLeaseId(), Tokens: req.GetTokens()})
+	if err != nil {
+		return nil, sidecarStatus(err)
+	}
+	return decisionToProto(reply), nil
+}
+
+func decisionToProto(d decisionReply) *sidecarpb.Decision {
+	return &sidecarpb.Decision{
+		Allowed:      d.Allowed,
+		Limit:        d.Limit,
+		Remaining:    d.Remaining,
+		ResetAfterMs: d.ResetAfterMillis,
+		LeaseId:      d.LeaseID,
+	}
+}
+
+func decisionFromProto(d *sidecarpb.Decision) decisionReply {
+	return decisionReply{
+		Allowed:          d.GetAllowed(),
+		Limit:            d.GetLimit(),
+		Remaining:        d.GetRemaining(),
+		ResetAfterMillis: d.GetResetAfterMs(),
+		LeaseID:          d.GetLeaseId(),
+	}
+}
+
+// sidecarStatus maps the sidecar's errors to the codes the HTTP API's
+// statuses correspond to.
+func sidecarStatus(err error) error {
+	switch {
+	case errors.Is(err, errBadRequest):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errLeaseNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Unavailable, "limiter unavailable: "+err.Error())
+}
+
+// sidecarClient calls the Limiter service, as a Go service using the
+// sidecar would.
+type sidecarClient struct {
+	client sidecarpb.LimiterClient
+}
+
+func newSidecarClient(conn grpc.ClientConnInterface) sidecarClient {
+	return sidecarClient{client: sidecarpb.NewLimiterClient(conn)}
+}
+
+func (c sidecarClient) Allow(ctx context.Context, req allowRequest) (decisionReply, error) {
+	d, err := c.client.Allow(ctx, &sidecarpb.AllowRequest{UserId: req.UserID, EndpointId: req.EndpointID, Tokens: req.Tokens})
+	return decisionFromProto(d), err
+}
+
+func (c sidecarClient) Reserve(ctx context.Context, req reserveRequest) (decisionReply, error) {
+	d, err := c.client.Reserve(ctx, &sidecarpb.ReserveRequest{
+		UserId:     req.UserID,
+		EndpointId: req.EndpointID,
+		Tokens:     req.Tokens,
+		TtlMs:      req.TTLMillis,
+	})
+	return decisionFromProto(d), err
+}
+
+func (c sidecarClient) Release(ctx context.Context, req releaseRequest) (releaseReply, error) {
+	r, err := c.client.Release(ctx, &sidecarpb.ReleaseRequest{LeaseId: req.LeaseID})
+	return releaseReply{Released: r.GetReleased()}, err
+}
+
+func (c sidecarClient) Commit(ctx context.Context, req commitRequest) (decisionReply, error) {
+	d, err := c.client.Commit(ctx, &sidecarpb.CommitRequest{LeaseId: req.LeaseID, Tokens: req.Tokens})
+	return decisionFromProto(d), err
+}
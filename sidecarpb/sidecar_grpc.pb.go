@@ -0,0 +1,247 @@
+// The sidecar's gRPC API (see sidecar.go). The Go code in sidecarpb is
+// generated from this file (see sidecar_grpc.go); other languages can
+// generate clients from it as usual.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: sidecar.proto
+
+package sidecarpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Limiter_Allow_FullMethodName   = "/ratelimit.sidecar.v1.Limiter/Allow"
+	Limiter_Reserve_FullMethodName = "/ratelimit.sidecar.v1.Limiter/Reserve"
+	Limiter_Release_FullMethodName = "/ratelimit.sidecar.v1.Limiter/Release"
+	Limiter_Commit_FullMethodName  = "/ratelimit.sidecar.v1.Limiter/Commit"
+)
+
+// LimiterClient is the client API for Limiter service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LimiterClient interface {
+	// Admit tokens' worth of work for user_id on endpoint_id
+	Allow(ctx context.Context, in *AllowRequest, opts ...grpc.CallOption) (*Decision, error)
+	// Like Allow, for work whose cost is only an estimate until Commit
+	Reserve(ctx context.Context, in *ReserveRequest, opts ...grpc.CallOption) (*Decision, error)
+	// Give back the slots a lease holds
+	Release(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseReply, error)
+	// Settle a lease at what the work actually cost and release it
+	Commit(ctx context.Context, in *CommitRequest, opts ...grpc.CallOption) (*Decision, error)
+}
+
+type limiterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLimiterClient(cc grpc.ClientConnInterface) LimiterClient {
+	return &limiterClient{cc}
+}
+
+func (c *limiterClient) Allow(ctx context.Context, in *AllowRequest, opts ...grpc.CallOption) (*Decision, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Decision)
+	err := c.cc.Invoke(ctx, Limiter_Allow_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *limiterClient) Reserve(ctx context.Context, in *ReserveRequest, opts ...grpc.CallOption) (*Decision, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Decision)
+	err := c.cc.Invoke(ctx, Limiter_Reserve_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *limiterClient) Release(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReleaseReply)
+	err := c.cc.Invoke(ctx, Limiter_Release_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *limiterClient) Commit(ctx context.Context, in *CommitRequest, opts ...grpc.CallOption) (*Decision, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Decision)
+	err := c.cc.Invoke(ctx, Limiter_Commit_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LimiterServer is the server API for Limiter service.
+// All implementations must embed UnimplementedLimiterServer
+// for forward compatibility.
+type LimiterServer interface {
+	// Admit tokens' worth of work for user_id on endpoint_id
+	Allow(context.Context, *AllowRequest) (*Decision, error)
+	// Like Allow, for work whose cost is only an estimate until Commit
+	Reserve(context.Context, *ReserveRequest) (*Decision, error)
+	// Give back the slots a lease holds
+	Release(context.Context, *ReleaseRequest) (*ReleaseReply, error)
+	// Settle a lease at what the work actually cost and release it
+	Commit(context.Context, *CommitRequest) (*Decision, error)
+	mustEmbedUnimplementedLimiterServer()
+}
+
+// UnimplementedLimiterServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedLimiterServer struct{}
+
+func (UnimplementedLimiterServer) Allow(context.Context, *AllowRequest) (*Decision, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Allow not implemented")
+}
+func (UnimplementedLimiterServer) Reserve(context.Context, *ReserveRequest) (*Decision, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reserve not implemented")
+}
+func (UnimplementedLimiterServer) Release(context.Context, *ReleaseRequest) (*ReleaseReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Release not implemented")
+}
+func (UnimplementedLimiterServer) Commit(context.Context, *CommitRequest) (*Decision, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Commit not implemented")
+}
+func (UnimplementedLimiterServer) mustEmbedUnimplementedLimiterServer() {}
+func (UnimplementedLimiterServer) testEmbeddedByValue()                 {}
+
+// UnsafeLimiterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LimiterServer will
+// result in compilation errors.
+type UnsafeLimiterServer interface {
+	mustEmbedUnimplementedLimiterServer()
+}
+
+func RegisterLimiterServer(s grpc.ServiceRegistrar, srv LimiterServer) {
+	// If the following call pancis, it indicates UnimplementedLimiterServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Limiter_ServiceDesc, srv)
+}
+
+func _Limiter_Allow_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AllowRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LimiterServer).Allow(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Limiter_Allow_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LimiterServer).Allow(ctx, req.(*AllowRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Limiter_Reserve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReserveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LimiterServer).Reserve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Limiter_Reserve_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LimiterServer).Reserve(ctx, req.(*ReserveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Limiter_Release_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LimiterServer).Release(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Limiter_Release_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LimiterServer).Release(ctx, req.(*ReleaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Limiter_Commit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LimiterServer).Commit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Limiter_Commit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LimiterServer).Commit(ctx, req.(*CommitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Limiter_ServiceDesc is the grpc.ServiceDesc for Limiter service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Limiter_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ratelimit.sidecar.v1.Limiter",
+	HandlerType: (*LimiterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Allow",
+			Handler:    _Limiter_Allow_Handler,
+		},
+		{
+			MethodName: "Reserve",
+			Handler:    _Limiter_Reserve_Handler,
+		},
+		{
+			MethodName: "Release",
+			Handler:    _Limiter_Release_Handler,
+		},
+		{
+			MethodName: "Commit",
+			Handler:    _Limiter_Commit_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "sidecar.proto",
+}
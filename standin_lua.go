@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// The stand-in runs scripts and functions as Redis does, on a Lua 5.1
+// interpreter: the source a client sends is what runs, and redis.call goes
+// through the same command handlers as a client's commands. Each node has
+// one Lua state, used with the store lock held, so a script is atomic.
+
+// standinReplies collects the replies the command handlers write, so
+// redis.call can hand them to the script. It only implements the writes.
+type standinReplies struct {
+	redcon.Conn
+	buf []byte
+}
+
+func (c *standinReplies) WriteError(msg string)       { c.buf = redcon.AppendError(c.buf, msg) }
+func (c *standinReplies) WriteString(str string)      { c.buf = redcon.AppendString(c.buf, str) }
+func (c *standinReplies) WriteBulk(bulk []byte)       { c.buf = redcon.AppendBulk(c.buf, bulk) }
+func (c *standinReplies) WriteBulkString(bulk string) { c.buf = redcon.AppendBulkString(c.buf, bulk) }
+func (c *standinReplies) WriteInt(num int)            { c.buf = redcon.AppendInt(c.buf, int64(num)) }
+func (c *standinReplies) WriteInt64(num int64)        { c.buf = redcon.AppendInt(c.buf, num) }
+func (c *standinReplies) WriteUint64(num uint64)      { c.buf = redcon.AppendUint(c.buf, num) }
+func (c *standinReplies) WriteArray(count int)        { c.buf = redcon.AppendArray(c.buf, count) }
+func (c *standinReplies) WriteNull()                  { c.buf = redcon.AppendNull(c.buf) }
+func (c *standinReplies) WriteRaw(data []byte)        { c.buf = append(c.buf, data...) }
+func (c *standinReplies) WriteAny(v any)              { c.buf = redcon.AppendAny(c.buf, v) }
+
+// luaState returns the node's Lua state, creating it on first use. It has
+// the libraries Redis scripts get and a redis table with call, pcall,
+// error_reply and status_reply.
+func (r *standinRedis) luaState() *lua.LState {
+	if r.lua != nil {
+		return r.lua
+	}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	reply := func(field string) lua.LGFunction {
+		return func(L *lua.LState) int {
+			t := L.NewTable()
+			t.RawSetString(field, lua.LString(L.CheckString(1)))
+			L.Push(t)
+			return 1
+		}
+	}
+	L.SetGlobal("redis", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"call":         func(L *lua.LState) int { return r.luaCall(L, true) },
+		"pcall":        func(L *lua.LState) int { return r.luaCall(L, false) },
+		"error_reply":  reply("err"),
+		"status_reply": reply("ok"),
+	}))
+	r.lua = L
+	return L
+}
+
+// luaCall runs redis.call's command. An error reply is raised, as a table
+// with err set like Redis 7 does, or returned that way by pcall.
+func (r *standinRedis) luaCall(L *lua.LState, raise bool) int {
+	n := L.GetTop()
+	if n == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		switch v := L.Get(i + 1).(type) {
+		case lua.LString:
+			args[i] = []byte(v)
+		case lua.LNumber:
+			args[i] = []byte(luaNumberString(v))
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	var replies standinReplies
+	r.dispatch(&replies, strings.ToLower(string(args[0])), args[1:])
+	_, resp := redcon.ReadNextRESP(replies.buf)
+	if resp.Type == redcon.Error {
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(resp.String()))
+		if raise {
+			L.Error(t, 1)
+		}
+		L.Push(t)
+		return 1
+	}
+	L.Push(respToLua(L, resp))
+	return 1
+}
+
+// luaNumberString formats a number argument as Lua 5.1's tostring does, so
+// integers such as millisecond timestamps are sent without an exponent.
+func luaNumberString(n lua.LNumber) string {
+	return strconv.FormatFloat(float64(n), 'g', 14, 64)
+}
+
+// respToLua converts a reply as Redis does for scripts: nil is false, a
+// status is {ok=...}, and arrays are tables.
+func respToLua(L *lua.LState, resp redcon.RESP) lua.LValue {
+	switch resp.Type {
+	case redcon.Integer:
+		return lua.LNumber(resp.Int())
+	case redcon.String:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(resp.String()))
+		return t
+	case redcon.Bulk:
+		if resp.Data == nil {
+			return lua.LFalse
+		}
+		return lua.LString(resp.Data)
+	case redcon.Array:
+		if resp.Count < 0 {
+			return lua.LFalse
+		}
+		t := L.NewTable()
+		resp.ForEach(func(item redcon.RESP) bool {
+			t.Append(respToLua(L, item))
+			return true
+		})
+		return t
+	}
+	return lua.LFalse
+}
+
+// luaToReply converts a script's return value as Redis does: numbers are
+// truncated to integers, true is 1, false is nil, and a table is an array up
+// to its first nil unless it is an {err=...} or {ok=...} reply.
+func luaToReply(v lua.LValue) any {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return redcon.SimpleInt(int64(v))
+	case lua.LString:
+		return string(v)
+	case lua.LBool:
+		if v {
+			return redcon.SimpleInt(1)
+		}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return errors.New(string(msg))
+		}
+		if status, ok := v.RawGetString("ok").(lua.LString); ok {
+			return redcon.SimpleString(status)
+		}
+		items := []any{}
+		for i := 1; v.RawGetInt(i) != lua.LNil; i++ {
+			items = append(items, luaToReply(v.RawGetInt(i)))
+		}
+		return items
+	}
+	return nil
+}
+
+// compileLua compiles source once, for every call after it to run.
+func compileLua(name string, source string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+// loadScript compiles an EVAL script and keeps it for EVALSHA.
+func (r *standinRedis) loadScript(source []byte) (*lua.FunctionProto, error) {
+	sha := scriptSHA(source)
+	if proto, ok := r.scripts[sha]; ok {
+		return proto, nil
+	}
+	proto, err := compileLua("user_script", string(source))
+	if err != nil {
+		return nil, err
+	}
+	if r.scripts == nil {
+		r.scripts = make(map[string]*lua.FunctionProto)
+	}
+	r.scripts[sha] = proto
+	return proto, nil
+}
+
+// loadLibrary runs a FUNCTION LOAD payload and returns the functions it
+// registers. The #!lua header isn't Lua, so it's left out.
+func (r *standinRedis) loadLibrary(code string) (map[string]*lua.LFunction, error) {
+	if fns, ok := r.functions[code]; ok {
+		return fns, nil
+	}
+	_, body, _ := strings.Cut(code, "\n")
+	proto, err := compileLua("library", body)
+	if err != nil {
+		return nil, err
+	}
+
+	L := r.luaState()
+	fns := make(map[string]*lua.LFunction)
+	redisTable := L.GetGlobal("redis").(*lua.LTable)
+	redisTable.RawSetString("register_function", L.NewFunction(func(L *lua.LState) int {
+		fns[L.CheckString(1)] = L.CheckFunction(2)
+		return 0
+	}))
+	defer redisTable.RawSetString("register_function", lua.LNil)
+	if err := L.CallByParam(lua.P{Fn: L.NewFunctionFromProto(proto), Protect: true}); err != nil {
+		return nil, err
+	}
+
+	if r.functions == nil {
+		r.functions = make(map[string]map[string]*lua.LFunction)
+	}
+	r.functions[code] = fns
+	return fns, nil
+}
+
+// function finds name among the functions of the libraries the store holds.
+func (r *standinRedis) function(name string) *lua.LFunction {
+	for _, code := range r.store.libraries {
+		fns, err := r.loadLibrary(code)
+		if err != nil {
+			continue
+		}
+		if fn, ok := fns[name]; ok {
+			return fn
+		}
+	}
+	return nil
+}
+
+// runLua runs fn with KEYS and ARGV set, and with them as its arguments for
+// a registered function, and converts what it returns into a reply.
+func (r *standinRedis) runLua(fn *lua.LFunction, keys []string, argv []string) any {
+	L := r.luaState()
+	keyTable, argTable := L.NewTable(), L.NewTable()
+	for _, key := range keys {
+		keyTable.Append(lua.LString(key))
+	}
+	for _, arg := range argv {
+		argTable.Append(lua.LString(arg))
+	}
+	L.SetGlobal("KEYS", keyTable)
+	L.SetGlobal("ARGV", argTable)
+
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, keyTable, argTable); err != nil {
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			// An error reply from redis.call is returned as it is
+			if t, ok := apiErr.Object.(*lua.LTable); ok {
+				if msg, ok := t.RawGetString("err").(lua.LString); ok {
+					return errors.New(string(msg))
+				}
+			}
+			return fmt.Errorf("ERR Error running script: %s", apiErr.Object.String())
+		}
+		return fmt.Errorf("ERR Error running script: %v", err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return luaToReply(ret)
+}
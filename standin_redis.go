@@ -0,0 +1,1004 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// standinRedis is an in-process RESP server that covers the subset of Redis
+// the limiter experiments use: strings, hashes and sorted sets with TTLs,
+// WATCH/MULTI/EXEC, and Lua scripts and functions (see standin_lua.go). It
+// lets the experiments run without a real Redis or Garnet. Several nodes can
+// share one store and split the slot space to stand in for a Redis Cluster.
+type standinRedis struct {
+	store  *standinStore
+	server *redcon.Server
+	addr   string
+
+	// slotLo and slotHi are the inclusive slot range this node serves when
+	// it is part of a stand-in cluster; nodes is the whole cluster.
+	slotLo, slotHi int
+	nodes          []*standinRedis
+
+	// readOnly makes the node answer writes like a replica, which is what a
+	// demoted primary does after a failover.
+	readOnly atomic.Bool
+
+	// noFunctions makes FUNCTION and FCALL unknown commands, as on Redis
+	// before 7.0 and on Garnet.
+	noFunctions bool
+
+	// commands are custom commands, like the ones Garnet modules register,
+	// given as the Lua script that does what the module would. They take
+	// numkeys key... arg..., as EVAL does.
+	commands map[string]string
+
+	// lua is the node's interpreter, scripts the EVAL scripts it has
+	// compiled by SHA1, and functions the functions of each library it has
+	// loaded, by library code.
+	lua       *lua.LState
+	scripts   map[string]*lua.FunctionProto
+	functions map[string]map[string]*lua.LFunction
+}
+
+// standinEntry is a string, or a hash or sorted set when one of those is
+// set.
+type standinEntry struct {
+	value   []byte
+	hash    map[string][]byte
+	zset    map[string]float64
+	expires time.Time
+}
+
+func (e *standinEntry) isString() bool { return e.hash == nil && e.zset == nil }
+
+const standinWrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+// standinStore is the keyspace. Every write bumps the key's version, which is
+// what WATCH compares at EXEC time.
+type standinStore struct {
+	mu      sync.Mutex
+	data    map[string]*standinEntry
+	version map[string]uint64
+
+	// libraries holds the code of loaded function libraries by name.
+	libraries map[string]string
+}
+
+type standinConn struct {
+	watched map[string]uint64
+	inMulti bool
+	aborted bool
+	queued  [][][]byte
+	txSlot  int
+}
+
+func newStandinStore() *standinStore {
+	return &standinStore{
+		data:      make(map[string]*standinEntry),
+		version:   make(map[string]uint64),
+		libraries: make(map[string]string),
+	}
+}
+
+func (s *standinStore) get(key string) *standinEntry {
+	e, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(s.data, key)
+		s.version[key]++
+		return nil
+	}
+	return e
+}
+
+func (s *standinStore) set(key string, value []byte, expires time.Time) {
+	s.data[key] = &standinEntry{value: value, expires: expires}
+	s.version[key]++
+}
+
+func (s *standinStore) del(key string) bool {
+	if s.get(key) == nil {
+		return false
+	}
+	delete(s.data, key)
+	s.version[key]++
+	return true
+}
+
+func (s *standinStore) getInt(key string) (int64, error) {
+	e := s.get(key)
+	if e == nil {
+		return 0, nil
+	}
+	if !e.isString() {
+		return 0, fmt.Errorf(standinWrongType)
+	}
+	n, err := strconv.ParseInt(string(e.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	return n, nil
+}
+
+func (s *standinStore) incrBy(key string, delta int64) (int64, error) {
+	n, err := s.getInt(key)
+	if err != nil {
+		return 0, err
+	}
+	n += delta
+	var expires time.Time
+	if e := s.get(key); e != nil {
+		expires = e.expires
+	}
+	s.set(key, []byte(strconv.FormatInt(n, 10)), expires)
+	return n, nil
+}
+
+func (s *standinStore) expire(key string, ttl time.Duration) bool {
+	e := s.get(key)
+	if e == nil {
+		return false
+	}
+	e.expires = time.Now().Add(ttl)
+	s.version[key]++
+	return true
+}
+
+// copyFrom replaces the keyspace with a snapshot of src, as a replica does
+// when it catches up with its primary.
+func (s *standinStore) copyFrom(src *standinStore) {
+	src.mu.Lock()
+	data := make(map[string]*standinEntry, len(src.data))
+	for key, e := range src.data {
+		data[key] = &standinEntry{value: e.value, hash: maps.Clone(e.hash), zset: maps.Clone(e.zset), expires: e.expires}
+	}
+	src.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.data {
+		s.version[key]++
+	}
+	for key := range data {
+		s.version[key]++
+	}
+	s.data = data
+}
+
+// startStandinRedis starts a single stand-in node on a random local port.
+func startStandinRedis() (*standinRedis, error) {
+	r := &standinRedis{store: newStandinStore(), slotLo: 0, slotHi: 16383}
+	if err := r.listen(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// startStandinCluster starts n nodes sharing one keyspace, each serving an
+// equal share of the 16384 slots and answering MOVED/CROSSSLOT like a cluster.
+func startStandinCluster(n int) ([]*standinRedis, error) {
+	store := newStandinStore()
+	nodes := make([]*standinRedis, n)
+	for i := range nodes {
+		nodes[i] = &standinRedis{
+			store:  store,
+			slotLo: i * 16384 / n,
+			slotHi: (i+1)*16384/n - 1,
+			nodes:  nodes,
+		}
+	}
+	for _, node := range nodes {
+		if err := node.listen(); err != nil {
+			for _, started := range nodes {
+				started.Close()
+			}
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+func (r *standinRedis) listen() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	r.addr = ln.Addr().String()
+	r.server = redcon.NewServer(r.addr, r.serveRESP,
+		func(conn redcon.Conn) bool {
+			conn.SetContext(&standinConn{txSlot: -1})
+			return true
+		},
+		nil,
+	)
+	go r.server.Serve(ln)
+	return nil
+}
+
+func (r *standinRedis) Addr() string { return r.addr }
+
+// registerCommand adds a custom command that runs script. Call it before
+// clients connect.
+func (r *standinRedis) registerCommand(name string, script string) {
+	if r.commands == nil {
+		r.commands = make(map[string]string)
+	}
+	r.commands[strings.ToLower(name)] = script
+}
+
+func (r *standinRedis) Close() error {
+	if r.server == nil {
+		return nil
+	}
+	return r.server.Close()
+}
+
+func (r *standinRedis) serveRESP(conn redcon.Conn, cmd redcon.Command) {
+	st := conn.Context().(*standinConn)
+	name := strings.ToLower(string(cmd.Args[0]))
+	args := cmd.Args[1:]
+
+	switch name {
+	case "multi":
+		if st.inMulti {
+			conn.WriteError("ERR MULTI calls can not be nested")
+			return
+		}
+		st.inMulti = true
+		conn.WriteString("OK")
+		return
+	case "discard":
+		if !st.inMulti {
+			conn.WriteError("ERR DISCARD without MULTI")
+			return
+		}
+		*st = standinConn{txSlot: -1}
+		conn.WriteString("OK")
+		return
+	case "exec":
+		r.exec(conn, st)
+		return
+	case "unwatch":
+		st.watched = nil
+		conn.WriteString("OK")
+		return
+	}
+
+	_, custom := r.commands[name]
+	if r.readOnly.Load() && (standinWrites[name] || custom) {
+		if st.inMulti {
+			st.aborted = true
+		}
+		conn.WriteError("READONLY You can't write against a read only replica.")
+		return
+	}
+
+	keys := standinKeys(name, args)
+	if custom {
+		keys = standinScriptKeys(args)
+	}
+	slot, err := r.route(keys)
+	if err != nil {
+		if st.inMulti {
+			st.aborted = true
+		}
+		conn.WriteError(err.Error())
+		return
+	}
+
+	if name == "watch" {
+		if st.inMulti {
+			conn.WriteError("ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		if st.watched == nil {
+			st.watched = make(map[string]uint64)
+		}
+		r.store.mu.Lock()
+		for _, key := range keys {
+			r.store.get(key)
+			st.watched[key] = r.store.version[key]
+		}
+		r.store.mu.Unlock()
+		conn.WriteString("OK")
+		return
+	}
+
+	if st.inMulti {
+		if slot >= 0 && st.txSlot >= 0 && slot != st.txSlot {
+			st.aborted = true
+			conn.WriteError("CROSSSLOT Keys in request don't hash to the same slot")
+			return
+		}
+		if slot >= 0 {
+			st.txSlot = slot
+		}
+		queued := make([][]byte, len(cmd.Args))
+		for i, arg := range cmd.Args {
+			queued[i] = append([]byte(nil), arg...)
+		}
+		st.queued = append(st.queued, queued)
+		conn.WriteString("QUEUED")
+		return
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	r.dispatch(conn, name, args)
+}
+
+func (r *standinRedis) exec(conn redcon.Conn, st *standinConn) {
+	if !st.inMulti {
+		conn.WriteError("ERR EXEC without MULTI")
+		return
+	}
+	queued, watched, aborted := st.queued, st.watched, st.aborted
+	*st = standinConn{txSlot: -1}
+	if aborted {
+		conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	for key, version := range watched {
+		r.store.get(key)
+		if r.store.version[key] != version {
+			conn.WriteRaw([]byte("*-1\r\n"))
+			return
+		}
+	}
+	conn.WriteArray(len(queued))
+	for _, args := range queued {
+		r.dispatch(conn, strings.ToLower(string(args[0])), args[1:])
+	}
+}
+
+// dispatch runs one command with the store lock held.
+func (r *standinRedis) dispatch(conn redcon.Conn, name string, args [][]byte) {
+	s := r.store
+	switch name {
+	case "ping":
+		conn.WriteString("PONG")
+	case "client", "select":
+		conn.WriteString("OK")
+	case "command":
+		r.commandCommand(conn, args)
+	case "cluster":
+		r.clusterCommand(conn, args)
+	case "scan":
+		r.scan(conn, args)
+	case "get":
+		if len(args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for 'get' command")
+			return
+		}
+		switch e := s.get(string(args[0])); {
+		case e == nil:
+			conn.WriteNull()
+		case !e.isString():
+			conn.WriteError(standinWrongType)
+		default:
+			conn.WriteBulk(e.value)
+		}
+	case "set":
+		r.set(conn, args)
+	case "exists":
+		var n int
+		for _, key := range args {
+			if s.get(string(key)) != nil {
+				n++
+			}
+		}
+		conn.WriteInt(n)
+	case "time":
+		now := time.Now()
+		conn.WriteArray(2)
+		conn.WriteBulkString(strconv.FormatInt(now.Unix(), 10))
+		conn.WriteBulkString(strconv.Itoa(now.Nanosecond() / 1000))
+	case "hset", "hmget":
+		r.hashCommand(conn, name, args)
+	case "zadd", "zrem", "zcard", "zremrangebyscore":
+		r.zsetCommand(conn, name, args)
+	case "del":
+		var n int
+		for _, key := range args {
+			if s.del(string(key)) {
+				n++
+			}
+		}
+		conn.WriteInt(n)
+	case "incr", "incrby", "decrby":
+		if len(args) < 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+			return
+		}
+		delta := int64(1)
+		if name != "incr" {
+			if len(args) != 2 {
+				conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+				return
+			}
+			var err error
+			if delta, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			if name == "decrby" {
+				delta = -delta
+			}
+		}
+		n, err := s.incrBy(string(args[0]), delta)
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		conn.WriteInt64(n)
+	case "expire", "pexpire":
+		if len(args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+			return
+		}
+		n, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			conn.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		unit := time.Second
+		if name == "pexpire" {
+			unit = time.Millisecond
+		}
+		// NX: only set a TTL on keys that have none
+		if len(args) > 2 && strings.EqualFold(string(args[2]), "nx") {
+			if e := s.get(string(args[0])); e == nil || !e.expires.IsZero() {
+				conn.WriteInt(0)
+				return
+			}
+		}
+		if s.expire(string(args[0]), time.Duration(n)*unit) {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+	case "ttl", "pttl":
+		if len(args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+			return
+		}
+		e := s.get(string(args[0]))
+		switch {
+		case e == nil:
+			conn.WriteInt(-2)
+		case e.expires.IsZero():
+			conn.WriteInt(-1)
+		case name == "ttl":
+			conn.WriteInt64(int64(time.Until(e.expires).Round(time.Second) / time.Second))
+		default:
+			conn.WriteInt64(time.Until(e.expires).Milliseconds())
+		}
+	case "evalsha", "eval":
+		r.eval(conn, name, args)
+	case "function", "fcall":
+		if r.noFunctions {
+			conn.WriteError("ERR unknown command '" + name + "'")
+			return
+		}
+		if name == "function" {
+			r.functionCommand(conn, args)
+		} else {
+			r.fcall(conn, args)
+		}
+	case "script":
+		if len(args) == 2 && strings.EqualFold(string(args[0]), "load") {
+			if _, err := r.loadScript(args[1]); err != nil {
+				conn.WriteError("ERR Error compiling script " + err.Error())
+				return
+			}
+			conn.WriteBulkString(scriptSHA(args[1]))
+			return
+		}
+		conn.WriteError("ERR unsupported SCRIPT subcommand")
+	default:
+		if script, ok := r.commands[name]; ok {
+			if len(args) < 1 {
+				conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+				return
+			}
+			proto, err := r.loadScript([]byte(script))
+			if err != nil {
+				conn.WriteError("ERR Error compiling script " + err.Error())
+				return
+			}
+			r.runScript(conn, r.luaState().NewFunctionFromProto(proto), args)
+			return
+		}
+		conn.WriteError("ERR unknown command '" + name + "'")
+	}
+}
+
+// commandCommand answers COMMAND with an empty table and COMMAND INFO with a
+// minimal entry for custom commands and nil for everything else.
+func (r *standinRedis) commandCommand(conn redcon.Conn, args [][]byte) {
+	if len(args) == 0 || !strings.EqualFold(string(args[0]), "info") {
+		conn.WriteArray(0)
+		return
+	}
+	conn.WriteArray(len(args) - 1)
+	for _, arg := range args[1:] {
+		name := strings.ToLower(string(arg))
+		if _, ok := r.commands[name]; !ok {
+			conn.WriteNull()
+			continue
+		}
+		// name, arity, flags, first key, last key, step
+		conn.WriteArray(6)
+		conn.WriteBulkString(name)
+		conn.WriteInt(-3)
+		conn.WriteArray(1)
+		conn.WriteString("write")
+		conn.WriteInt(0)
+		conn.WriteInt(0)
+		conn.WriteInt(0)
+	}
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT n] in one pass: it returns
+// every matching key this node serves with cursor 0. Patterns are matched as
+// path.Match does, which covers the * and ? globs the experiments use.
+func (r *standinRedis) scan(conn redcon.Conn, args [][]byte) {
+	if len(args) < 1 {
+		conn.WriteError("ERR wrong number of arguments for 'scan' command")
+		return
+	}
+	pattern := "*"
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.EqualFold(string(args[i]), "match") {
+			pattern = string(args[i+1])
+		}
+	}
+	var keys []string
+	for key := range r.store.data {
+		if r.store.get(key) == nil {
+			continue
+		}
+		if r.nodes != nil {
+			if slot := keySlot(key); slot < r.slotLo || slot > r.slotHi {
+				continue
+			}
+		}
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	conn.WriteArray(2)
+	conn.WriteBulkString("0")
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		conn.WriteBulkString(key)
+	}
+}
+
+// set handles SET key value [NX|XX] [GET] [EX s|PX ms|KEEPTTL].
+func (r *standinRedis) set(conn redcon.Conn, args [][]byte) {
+	if len(args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'set' command")
+		return
+	}
+	key, value := string(args[0]), append([]byte(nil), args[1]...)
+	var nx, xx, get, keepTTL bool
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "get":
+			get = true
+		case "keepttl":
+			keepTTL = true
+		case "ex", "px":
+			if i+1 >= len(args) {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				conn.WriteError("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * time.Second
+			if strings.EqualFold(string(args[i]), "px") {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+			i++
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	old := r.store.get(key)
+	reply := func(done bool) {
+		switch {
+		case get && old != nil:
+			conn.WriteBulk(old.value)
+		case get:
+			conn.WriteNull()
+		case done:
+			conn.WriteString("OK")
+		default:
+			conn.WriteNull()
+		}
+	}
+	if (nx && old != nil) || (xx && old == nil) {
+		reply(false)
+		return
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	} else if keepTTL && old != nil {
+		expires = old.expires
+	}
+	r.store.set(key, value, expires)
+	reply(true)
+}
+
+func (r *standinRedis) eval(conn redcon.Conn, name string, args [][]byte) {
+	if len(args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+		return
+	}
+	var proto *lua.FunctionProto
+	if name == "eval" {
+		var err error
+		if proto, err = r.loadScript(args[0]); err != nil {
+			conn.WriteError("ERR Error compiling script " + err.Error())
+			return
+		}
+	} else if proto = r.scripts[strings.ToLower(string(args[0]))]; proto == nil {
+		conn.WriteError("NOSCRIPT No matching script. Please use EVAL.")
+		return
+	}
+	r.runScript(conn, r.luaState().NewFunctionFromProto(proto), args[1:])
+}
+
+// runScript splits numkeys key... arg... and runs fn with them.
+func (r *standinRedis) runScript(conn redcon.Conn, fn *lua.LFunction, args [][]byte) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil || numKeys < 0 || numKeys > len(args)-1 {
+		conn.WriteError("ERR Number of keys can't be greater than number of args")
+		return
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[1+i])
+	}
+	argv := make([]string, len(args)-1-numKeys)
+	for i := range argv {
+		argv[i] = string(args[1+numKeys+i])
+	}
+	conn.WriteAny(r.runLua(fn, keys, argv))
+}
+
+// functionCommand handles FUNCTION LOAD [REPLACE] code. The library name
+// comes from the #!lua header.
+func (r *standinRedis) functionCommand(conn redcon.Conn, args [][]byte) {
+	if len(args) < 2 || !strings.EqualFold(string(args[0]), "load") {
+		conn.WriteError("ERR unsupported FUNCTION subcommand")
+		return
+	}
+	replace := len(args) == 3 && strings.EqualFold(string(args[1]), "replace")
+	code := string(args[len(args)-1])
+	header, _, _ := strings.Cut(code, "\n")
+	libName, ok := strings.CutPrefix(header, "#!lua name=")
+	if !ok {
+		conn.WriteError("ERR Missing library metadata")
+		return
+	}
+	if _, ok := r.store.libraries[libName]; ok && !replace {
+		conn.WriteError("ERR Library '" + libName + "' already exists")
+		return
+	}
+	if _, err := r.loadLibrary(code); err != nil {
+		conn.WriteError("ERR Error compiling function: " + err.Error())
+		return
+	}
+	r.store.libraries[libName] = code
+	conn.WriteBulkString(libName)
+}
+
+// fcall handles FCALL function numkeys key... arg...
+func (r *standinRedis) fcall(conn redcon.Conn, args [][]byte) {
+	if len(args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'fcall' command")
+		return
+	}
+	fn := r.function(string(args[0]))
+	if fn == nil {
+		conn.WriteError("ERR Function not found")
+		return
+	}
+	r.runScript(conn, fn, args[1:])
+}
+
+// hashCommand handles HSET key field value... and HMGET key field...
+func (r *standinRedis) hashCommand(conn redcon.Conn, name string, args [][]byte) {
+	if len(args) < 2 || (name == "hset" && len(args)%2 != 1) {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+		return
+	}
+	key := string(args[0])
+	e := r.store.get(key)
+	if e != nil && e.hash == nil {
+		conn.WriteError(standinWrongType)
+		return
+	}
+	if name == "hmget" {
+		conn.WriteArray(len(args) - 1)
+		for _, field := range args[1:] {
+			if e == nil || e.hash[string(field)] == nil {
+				conn.WriteNull()
+			} else {
+				conn.WriteBulk(e.hash[string(field)])
+			}
+		}
+		return
+	}
+	if e == nil {
+		e = &standinEntry{hash: make(map[string][]byte)}
+		r.store.data[key] = e
+	}
+	added := 0
+	for i := 1; i < len(args); i += 2 {
+		if e.hash[string(args[i])] == nil {
+			added++
+		}
+		e.hash[string(args[i])] = append([]byte{}, args[i+1]...)
+	}
+	r.store.version[key]++
+	conn.WriteInt(added)
+}
+
+// zsetCommand handles ZADD key score member..., ZREM key member...,
+// ZCARD key and ZREMRANGEBYSCORE key min max.
+func (r *standinRedis) zsetCommand(conn redcon.Conn, name string, args [][]byte) {
+	arity := map[string]func(int) bool{
+		"zadd":             func(n int) bool { return n >= 3 && n%2 == 1 },
+		"zrem":             func(n int) bool { return n >= 2 },
+		"zcard":            func(n int) bool { return n == 1 },
+		"zremrangebyscore": func(n int) bool { return n == 3 },
+	}
+	if !arity[name](len(args)) {
+		conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+		return
+	}
+	key := string(args[0])
+	e := r.store.get(key)
+	if e != nil && e.zset == nil {
+		conn.WriteError(standinWrongType)
+		return
+	}
+
+	switch name {
+	case "zcard":
+		if e == nil {
+			conn.WriteInt(0)
+		} else {
+			conn.WriteInt(len(e.zset))
+		}
+		return
+	case "zadd":
+		scores := make([]float64, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(string(args[i]), 64)
+			if err != nil {
+				conn.WriteError("ERR value is not a valid float")
+				return
+			}
+			scores = append(scores, score)
+		}
+		if e == nil {
+			e = &standinEntry{zset: make(map[string]float64)}
+			r.store.data[key] = e
+		}
+		added := 0
+		for i, score := range scores {
+			member := string(args[2+2*i])
+			if _, ok := e.zset[member]; !ok {
+				added++
+			}
+			e.zset[member] = score
+		}
+		r.store.version[key]++
+		conn.WriteInt(added)
+		return
+	}
+
+	removed := 0
+	if e != nil {
+		if name == "zrem" {
+			for _, member := range args[1:] {
+				if _, ok := e.zset[string(member)]; ok {
+					delete(e.zset, string(member))
+					removed++
+				}
+			}
+		} else {
+			lo, loOpen, err1 := parseScoreBound(args[1])
+			hi, hiOpen, err2 := parseScoreBound(args[2])
+			if err1 != nil || err2 != nil {
+				conn.WriteError("ERR min or max is not a float")
+				return
+			}
+			for member, score := range e.zset {
+				if (score > lo || (!loOpen && score == lo)) && (score < hi || (!hiOpen && score == hi)) {
+					delete(e.zset, member)
+					removed++
+				}
+			}
+		}
+	}
+	if removed > 0 {
+		r.store.version[key]++
+		if len(e.zset) == 0 {
+			r.store.del(key)
+		}
+	}
+	conn.WriteInt(removed)
+}
+
+// parseScoreBound reads a ZRANGEBYSCORE bound: a float, -inf or +inf, with
+// a leading ( making it exclusive.
+func parseScoreBound(b []byte) (float64, bool, error) {
+	s, open := strings.CutPrefix(string(b), "(")
+	switch strings.ToLower(s) {
+	case "-inf":
+		return math.Inf(-1), open, nil
+	case "+inf", "inf":
+		return math.Inf(1), open, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, open, err
+}
+
+func (r *standinRedis) clusterCommand(conn redcon.Conn, args [][]byte) {
+	if len(args) == 0 || !strings.EqualFold(string(args[0]), "slots") {
+		conn.WriteError("ERR unsupported CLUSTER subcommand")
+		return
+	}
+	if r.nodes == nil {
+		conn.WriteError("ERR This instance has cluster support disabled")
+		return
+	}
+	conn.WriteArray(len(r.nodes))
+	for i, node := range r.nodes {
+		host, port, _ := net.SplitHostPort(node.addr)
+		p, _ := strconv.Atoi(port)
+		conn.WriteArray(3)
+		conn.WriteInt(node.slotLo)
+		conn.WriteInt(node.slotHi)
+		conn.WriteArray(3)
+		conn.WriteBulkString(host)
+		conn.WriteInt(p)
+		conn.WriteBulkString(fmt.Sprintf("standin-%d", i))
+	}
+}
+
+// route checks that all keys hash to one slot served by this node, returning
+// that slot. Keyless commands and standalone nodes get -1.
+func (r *standinRedis) route(keys []string) (int, error) {
+	if len(keys) == 0 || r.nodes == nil {
+		return -1, nil
+	}
+	slot := keySlot(keys[0])
+	for _, key := range keys[1:] {
+		if keySlot(key) != slot {
+			return 0, fmt.Errorf("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	if slot >= r.slotLo && slot <= r.slotHi {
+		return slot, nil
+	}
+	for _, node := range r.nodes {
+		if slot >= node.slotLo && slot <= node.slotHi {
+			return 0, fmt.Errorf("MOVED %d %s", slot, node.addr)
+		}
+	}
+	return 0, fmt.Errorf("CLUSTERDOWN Hash slot not served")
+}
+
+var standinWrites = map[string]bool{
+	"set": true, "del": true, "incr": true, "incrby": true, "decrby": true,
+	"expire": true, "pexpire": true, "eval": true, "evalsha": true,
+	"function": true, "fcall": true, "hset": true, "zadd": true, "zrem": true,
+	"zremrangebyscore": true,
+}
+
+// standinKeys returns the key arguments of the commands the stand-in supports.
+func standinKeys(name string, args [][]byte) []string {
+	var raw [][]byte
+	switch name {
+	case "get", "set", "incr", "incrby", "decrby", "expire", "pexpire", "ttl", "pttl",
+		"hset", "hmget", "zadd", "zrem", "zcard", "zremrangebyscore":
+		if len(args) > 0 {
+			raw = args[:1]
+		}
+	case "del", "exists", "watch":
+		raw = args
+	case "evalsha", "eval", "fcall":
+		if len(args) >= 1 {
+			return standinScriptKeys(args[1:])
+		}
+	}
+	keys := make([]string, len(raw))
+	for i, k := range raw {
+		keys[i] = string(k)
+	}
+	return keys
+}
+
+// standinScriptKeys returns the keys of numkeys key... arg... arguments.
+func standinScriptKeys(args [][]byte) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	n, err := strconv.Atoi(string(args[0]))
+	if err != nil || n < 0 || n > len(args)-1 {
+		return nil
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = string(args[1+i])
+	}
+	return keys
+}
+
+func scriptSHA(script []byte) string {
+	sum := sha1.Sum(script)
+	return hex.EncodeToString(sum[:])
+}
+
+// keySlot is the Redis Cluster slot for key, honoring {hash tags}.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % 16384)
+}
+
+// crc16 is CRC-16/XMODEM, the checksum Redis Cluster uses for key slots.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
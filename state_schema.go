@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Stored LimiterState values are framed with a 3-byte header:
+//
+//	[stateHeaderMagic, schema version, codec ID]
+//
+// followed by the codec's payload. Values written before the header existed are
+// bare JSON objects and are read as schema version 1.
+const (
+	stateHeaderMagic   = 0x00
+	stateSchemaVersion = 2
+)
+
+// stateMigrations upgrades a decoded state from version v (the map key) to
+// v+1. Decoding always goes into the current LimiterState, so migrations only
+// need to fix up values whose meaning changed, not the wire format.
+var stateMigrations = map[uint8]func(state *LimiterState){
+	1: migrateStateV1,
+}
+
+// migrateStateV1 gives legacy windows an explicit period. Version 1 windows
+// never reset on their own; they went away when the key's 24h TTL lapsed, so
+// that is the period they get.
+func migrateStateV1(state *LimiterState) {
+	for i := range state.SlidingWindows {
+		if state.SlidingWindows[i].Period == 0 {
+			state.SlidingWindows[i].Period = 24 * time.Hour
+		}
+	}
+	for i := range state.FixedWindow {
+		if state.FixedWindow[i].Period == 0 {
+			state.FixedWindow[i].Period = 24 * time.Hour
+		}
+	}
+}
+
+// encodeState frames state with the current schema version and stateCodec.
+func encodeState(state LimiterState) ([]byte, error) {
+	payload, err := stateCodec.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, 3+len(payload))
+	data = append(data, stateHeaderMagic, stateSchemaVersion, stateCodec.ID())
+	return append(data, payload...), nil
+}
+
+// decodeState reads a value written by encodeState or by the pre-header
+// strategies, running any migrations needed to bring it to the current version.
+// The codec comes from the header, so values written with a different
+// STATE_CODEC than the current run are still readable.
+func decodeState(data []byte, state *LimiterState) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty state")
+	}
+
+	var version uint8
+	if data[0] == '{' {
+		version = 1
+		if err := json.Unmarshal(data, state); err != nil {
+			return err
+		}
+	} else {
+		if len(data) < 3 || data[0] != stateHeaderMagic {
+			return fmt.Errorf("state has no schema header")
+		}
+		version = data[1]
+		codec, ok := codecByID(data[2])
+		if !ok {
+			return fmt.Errorf("unknown state codec ID %d", data[2])
+		}
+		if err := codec.Unmarshal(data[3:], state); err != nil {
+			return err
+		}
+	}
+
+	if version > stateSchemaVersion {
+		return fmt.Errorf("state schema version %d is newer than supported version %d", version, stateSchemaVersion)
+	}
+	for ; version < stateSchemaVersion; version++ {
+		migrate, ok := stateMigrations[version]
+		if !ok {
+			return fmt.Errorf("no migration from state schema version %d", version)
+		}
+		migrate(state)
+	}
+	return nil
+}
+
+// main11 checks that a key written in the pre-header format (a bare JSON
+// LimiterState, as updateLimiterStateWithLock used to store it) is picked up by
+// the current code, migrated, and rewritten with a header.
+func main11() {
+	rdb := newRedisClient()
+	defer rdb.Close()
+
+	ctx := context.Background()
+	userID := "test_user"
+	endpointID := "test_endpoint"
+	key := limiterKey(userID, endpointID)
+
+	legacy, _ := json.Marshal(LimiterState{
+		SlidingWindows: []SlidingWindow{{Count: 42, Limit: 500, StartTime: time.Now()}},
+		FixedWindow:    []FixedWindow{{Count: 42, Limit: 500, StartTime: time.Now()}},
+	})
+	rdb.Set(ctx, key, legacy, 24*time.Hour)
+
+	if _, err := updateLimiterStateWithLock(ctx, rdb, userID, endpointID, 1); err != nil {
+		log.Fatalf("update of legacy key failed: %v", err)
+	}
+
+	val, err := rdb.Get(ctx, key).Bytes()
+	if err != nil {
+		log.Fatalf("failed to read migrated key: %v", err)
+	}
+	fmt.Printf("Header: magic=%d version=%d codec=%d\n", val[0], val[1], val[2])
+
+	var state LimiterState
+	if err := decodeState(val, &state); err != nil {
+		log.Fatalf("failed to decode migrated key: %v", err)
+	}
+	fmt.Printf("Sliding Window: %d/%d (period %v)\n",
+		state.SlidingWindows[0].Count, state.SlidingWindows[0].Limit, state.SlidingWindows[0].Period)
+	fmt.Printf("Fixed Window: %d/%d (period %v)\n",
+		state.FixedWindow[0].Count, state.FixedWindow[0].Limit, state.FixedWindow[0].Period)
+
+	if val[1] != stateSchemaVersion || state.SlidingWindows[0].Count != 43 || state.FixedWindow[0].Count != 43 {
+		log.Fatalf("legacy key was not migrated correctly")
+	}
+	fmt.Println("Legacy key migrated OK")
+}
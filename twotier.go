@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric"
+	"github.com/redis/go-redis/v9"
+)
+
+// totalsStore is the shared side of the two-tier limiter: it only has to add
+// a delta to a counter and say what the counter is now, and when its window
+// ends (zero if it doesn't).
+type totalsStore interface {
+	add(ctx context.Context, key string, delta int64, window time.Duration) (int64, time.Time, error)
+}
+
+type redisTotalsStore struct {
+	rdb redis.UniversalClient
+}
+
+func (s redisTotalsStore) add(ctx context.Context, key string, delta int64, window time.Duration) (int64, time.Time, error) {
+	pipe := s.rdb.Pipeline()
+	total := pipe.IncrBy(ctx, key, delta)
+	pipe.ExpireNX(ctx, key, window)
+	ttl := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, time.Time{}, err
+	}
+	var windowEnd time.Time
+	if ttl.Val() > 0 {
+		windowEnd = time.Now().Add(ttl.Val())
+	}
+	return total.Val(), windowEnd, nil
+}
+
+// olricTotalsStore keeps one counter per aligned window, as olricLeaseStore
+// does, since Olric can't reset a counter in place. A delta flushed after
+// its window ended counts toward the new one.
+type olricTotalsStore struct {
+	dm olric.DMap
+}
+
+func (s olricTotalsStore) add(ctx context.Context, key string, delta int64, window time.Duration) (int64, time.Time, error) {
+	var windowEnd time.Time
+	if window > 0 {
+		windowEnd = alignedWindowEnd(time.Now(), window)
+		key = olricWindowKey(key, windowEnd)
+	}
+	total, err := s.dm.Incr(ctx, key, int(delta))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if window > 0 {
+		if err := s.dm.Expire(ctx, key, time.Until(windowEnd)+window); err != nil {
+			return 0, time.Time{}, fmt.Errorf("failed to set window expiry: %w", err)
+		}
+	}
+	return int64(total), windowEnd, nil
+}
+
+// tierCounter is one key's local view: the global total as of the last sync
+// plus what this process admitted since.
+type tierCounter struct {
+	global    int64
+	pending   int64
+	synced    time.Time
+	windowEnd time.Time
+	// read is whether Allow has looked at the key since its last sync, and
+	// used when it last did
+	read bool
+	used time.Time
+}
+
+// twoTierLimiter admits from memory, for endpoints where a little overshoot is
+// fine (the README's INCRBY recommendation) but a round-trip per request
+// isn't. Admitted units are flushed to the shared store in the background,
+// which also brings back what the other processes admitted. No key's view is
+// older than maxStaleness when a request is decided: the background loop
+// syncs every maxStaleness/2, and a request that finds its key older than
+// that syncs inline first.
+//
+// Overshoot is bounded by what the other processes can admit in maxStaleness,
+// since each one only sees the others' usage after a sync. The background
+// loop only syncs keys with units to flush or that were read since the last
+// sync, and drops keys idle for longer than the window.
+type twoTierLimiter struct {
+	store        totalsStore
+	limit        int64
+	window       time.Duration
+	maxStaleness time.Duration
+
+	mu       sync.Mutex
+	counters map[string]*tierCounter
+	// syncMu keeps syncs from overlapping, so a flushed delta can't be
+	// counted twice in global.
+	syncMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newTwoTierLimiter(store totalsStore, limit int64, window time.Duration, maxStaleness time.Duration) *twoTierLimiter {
+	l := &twoTierLimiter{
+		store:        store,
+		limit:        limit,
+		window:       window,
+		maxStaleness: maxStaleness,
+		counters:     make(map[string]*tierCounter),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go l.loop()
+	return l
+}
+
+func (l *twoTierLimiter) loop() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.maxStaleness / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.sync(context.Background(), nil)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Allow decides locally; it only touches the shared store if the key's view
+// is too stale. The Decision's Remaining is what this process's view leaves.
+func (l *twoTierLimiter) Allow(ctx context.Context, userID string, endpointID string, tokens int64) (Decision, error) {
+	key := windowKey("twotier", userID, endpointID)
+
+	l.mu.Lock()
+	c := l.counters[key]
+	if c == nil {
+		c = &tierCounter{}
+		l.counters[key] = c
+	}
+	c.read = true
+	c.used = time.Now()
+	stale := time.Since(c.synced) > l.maxStaleness
+	l.mu.Unlock()
+
+	if stale {
+		if err := l.sync(ctx, []string{key}); err != nil {
+			return Decision{}, err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := Decision{Allowed: c.global+c.pending+tokens <= l.limit, Limit: l.limit}
+	if d.Allowed {
+		c.pending += tokens
+	}
+	d.Remaining = max(l.limit-c.global-c.pending, 0)
+	if !c.windowEnd.IsZero() {
+		d.ResetAfter = max(time.Until(c.windowEnd), 0)
+	}
+	return d, nil
+}
+
+// Release is a no-op: spent units only come back when their window resets.
+func (l *twoTierLimiter) Release(ctx context.Context, userID string, endpointID string, leaseID string) error {
+	return nil
+}
+
+// sync flushes pending deltas for keys and refreshes their global totals. If
+// keys is nil it syncs every key with a delta or read since its last sync,
+// and drops the others once they've been idle for longer than the window.
+func (l *twoTierLimiter) sync(ctx context.Context, keys []string) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	l.mu.Lock()
+	if keys == nil {
+		now := time.Now()
+		for key, c := range l.counters {
+			switch {
+			case c.pending != 0 || c.read:
+				keys = append(keys, key)
+			case l.window > 0 && now.Sub(c.used) > l.window:
+				delete(l.counters, key)
+			}
+		}
+	}
+	deltas := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		c := l.counters[key]
+		deltas[key] = c.pending
+		c.pending = 0
+		c.read = false
+	}
+	l.mu.Unlock()
+
+	var firstErr error
+	for _, key := range keys {
+		total, windowEnd, err := l.store.add(ctx, key, deltas[key], l.window)
+		l.mu.Lock()
+		c := l.counters[key]
+		if err != nil {
+			// Keep the units to flush next time
+			c.pending += deltas[key]
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to sync %s: %w", key, err)
+			}
+		} else {
+			c.global = total
+			c.windowEnd = windowEnd
+			c.synced = time.Now()
+		}
+		l.mu.Unlock()
+	}
+	return firstErr
+}
+
+// Close stops the background loop and flushes what is left.
+func (l *twoTierLimiter) Close(ctx context.Context) error {
+	close(l.stop)
+	<-l.done
+	return l.sync(ctx, nil)
+}
+
+// main19 compares the two-tier limiter with the single-tier INCRBY strategies
+// under the same load: four processes of 10 goroutines, each making a request
+// every 200µs, against a 500 limit. The two-tier rows are run at several
+// staleness bounds; overshoot grows with staleness and the number of
+// processes, while the single-tier rows pay a round-trip per request.
+func main19() {
+	const (
+		processes    = 4
+		twoTierLimit = 500
+		perRoutine   = 50
+	)
+	ctx := context.Background()
+	userID := "test_user"
+	endpointID := "test_endpoint"
+
+	server, err := startStandinRedis()
+	if err != nil {
+		log.Fatalf("failed to start stand-in: %v", err)
+	}
+	defer server.Close()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+	defer rdb.Close()
+
+	dm, shutdown, err := startOlric("twotier")
+	if err != nil {
+		log.Fatalf("failed to start Olric: %v", err)
+	}
+	defer shutdown()
+
+	// run drives processes*numRoutines goroutines through allow and returns
+	// how many requests were admitted and how long it took.
+	run := func(allow func(process int) (bool, error)) (int64, time.Duration) {
+		var allowed atomic.Int64
+		var wg sync.WaitGroup
+		startTime := time.Now()
+		for p := 0; p < processes; p++ {
+			for i := 0; i < numRoutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < perRoutine; j++ {
+						ok, err := allow(p)
+						if err != nil {
+							log.Printf("Error: %v", err)
+						} else if ok {
+							allowed.Add(1)
+						}
+						time.Sleep(200 * time.Microsecond)
+					}
+				}()
+			}
+		}
+		wg.Wait()
+		return allowed.Load(), time.Since(startTime)
+	}
+
+	fmt.Printf("%-8s %-22s %8s %10s %12s\n", "backend", "strategy", "allowed", "overshoot", "total time")
+	report := func(backend, strategy string, allowed int64, elapsed time.Duration) {
+		fmt.Printf("%-8s %-22s %8d %10d %12v\n", backend, strategy, allowed, max(allowed-twoTierLimit, 0), elapsed.Round(time.Millisecond))
+	}
+
+	runTwoTier := func(backend string, store totalsStore, reset func()) {
+		for _, staleness := range []time.Duration{2 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond} {
+			reset()
+			limiters := make([]*twoTierLimiter, processes)
+			for i := range limiters {
+				limiters[i] = newTwoTierLimiter(store, twoTierLimit, 24*time.Hour, staleness)
+			}
+			allowed, elapsed := run(func(p int) (bool, error) {
+				d, err := limiters[p].Allow(ctx, userID, endpointID, 1)
+				return d.Allowed, err
+			})
+			for _, limiter := range limiters {
+				if err := limiter.Close(ctx); err != nil {
+					log.Printf("Error flushing: %v", err)
+				}
+			}
+			report(backend, fmt.Sprintf("two-tier (%v)", staleness), allowed, elapsed)
+		}
+	}
+
+	twoTierKey := windowKey("twotier", userID, endpointID)
+	runTwoTier("redis", redisTotalsStore{rdb: rdb}, func() { rdb.Del(ctx, twoTierKey) })
+	for _, window := range []string{"window1", "window2", "window3"} {
+		rdb.Del(ctx, windowKey(window, userID, endpointID))
+	}
+	allowed, elapsed := run(func(int) (bool, error) {
+		d, err := updateLimiterState2(ctx, rdb, userID, endpointID, 1)
+		return err == nil && d.Allowed, nil
+	})
+	report("redis", "single-tier incrby", allowed, elapsed)
+
+	runTwoTier("olric", olricTotalsStore{dm: dm}, func() {
+		dm.Delete(ctx, olricWindowKey(twoTierKey, alignedWindowEnd(time.Now(), 24*time.Hour)))
+	})
+	allowed, elapsed = run(func(int) (bool, error) {
+		d, err := updateLimiterState5(ctx, dm, userID, endpointID, 1)
+		return err == nil && d.Allowed, nil
+	})
+	report("olric", "single-tier incr", allowed, elapsed)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2/event"
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+)
+
+var errBatcherClosed = errors.New("usage batcher is closed")
+
+// usageBatcher sends events to OpenMeter in batches of up to maxBatch, or
+// whatever has built up after maxDelay, with up to maxInFlight requests at
+// once. At most maxQueued events wait in memory; past that, Log blocks until
+// there is room or its context ends, which pushes back on callers instead of
+// growing without bound.
+type usageBatcher struct {
+	client      *openmeter.ClientWithResponses
+	maxBatch    int
+	maxDelay    time.Duration
+	maxInFlight int
+
+	queue    chan queuedUsage
+	inFlight chan struct{}
+	sends    sync.WaitGroup
+
+	closeMu sync.RWMutex
+	closed  bool
+	done    chan struct{}
+
+	sent    atomic.Int64
+	failed  atomic.Int64
+	lastErr atomic.Value
+}
+
+func newUsageBatcher(client *openmeter.ClientWithResponses, maxBatch int, maxDelay time.Duration, maxQueued int) *usageBatcher {
+	const maxInFlight = 4
+	b := &usageBatcher{
+		client:      client,
+		maxBatch:    maxBatch,
+		maxDelay:    maxDelay,
+		maxInFlight: maxInFlight,
+		queue:       make(chan queuedUsage, maxQueued),
+		inFlight:    make(chan struct{}, maxInFlight),
+		done:        make(chan struct{}),
+	}
+	go b.loop()
+	return b
+}
+
+// queuedUsage is an event waiting to be sent, with what to do if sending it
+// fails.
+type queuedUsage struct {
+	event    cloudevents.Event
+	onFailed func()
+}
+
+// Log queues e, blocking while the queue is full. onFailed, if not nil, is
+// called if the batch e goes out in fails, since Log has returned by then.
+func (b *usageBatcher) Log(ctx context.Context, e cloudevents.Event, onFailed func()) error {
+	b.closeMu.RLock()
+	defer b.closeMu.RUnlock()
+	if b.closed {
+		return errBatcherClosed
+	}
+	select {
+	case b.queue <- queuedUsage{event: e, onFailed: onFailed}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to queue usage: %w", ctx.Err())
+	}
+}
+
+func (b *usageBatcher) loop() {
+	defer close(b.done)
+	batch := make([]queuedUsage, 0, b.maxBatch)
+	timer := time.NewTimer(b.maxDelay)
+	timer.Stop()
+
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		b.send(batch)
+		batch = make([]queuedUsage, 0, b.maxBatch)
+	}
+
+	for {
+		select {
+		case e, ok := <-b.queue:
+			if !ok {
+				send()
+				b.sends.Wait()
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(b.maxDelay)
+			}
+			batch = append(batch, e)
+			if len(batch) >= b.maxBatch {
+				timer.Stop()
+				send()
+			}
+		case <-timer.C:
+			send()
+		}
+	}
+}
+
+// send ships batch on its own goroutine once one of the maxInFlight slots
+// is free. Waiting for the slot stalls the loop, which fills the queue,
+// which blocks Log: that is the backpressure.
+func (b *usageBatcher) send(batch []queuedUsage) {
+	b.inFlight <- struct{}{}
+	b.sends.Add(1)
+	go func() {
+		defer func() {
+			<-b.inFlight
+			b.sends.Done()
+		}()
+		events := make([]cloudevents.Event, len(batch))
+		for i, q := range batch {
+			events[i] = q.event
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := sendUsageBatch(ctx, b.client, events); err != nil {
+			b.failed.Add(int64(len(batch)))
+			b.lastErr.Store(err)
+			log.Printf("Failed to send %d usage events: %v", len(batch), err)
+			for _, q := range batch {
+				if q.onFailed != nil {
+					q.onFailed()
+				}
+			}
+			return
+		}
+		b.sent.Add(int64(len(batch)))
+	}()
+}
+
+// Close stops accepting events and sends everything queued. It returns the
+// last send error, if any, or ctx's error if the flush outlives it.
+func (b *usageBatcher) Close(ctx context.Context) error {
+	b.closeMu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.closeMu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return fmt.Errorf("usage flush did not finish: %w", ctx.Err())
+	}
+	if err, ok := b.lastErr.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// main21 logs 1000 events from 10 goroutines against a stand-in ingest
+// endpoint that takes 25ms per request, as OpenMeter did: one request per
+// event through LogUsage, then through the batcher, then through a batcher
+// with batches of 10 and only 20 events of queue, where the four requests in
+// flight can't keep up and LogUsage has to wait for room.
+func main21() {
+	const (
+		totalEvents   = 1000
+		ingestLatency = 25 * time.Millisecond
+	)
+	ctx := context.Background()
+
+	fmt.Printf("%-16s %8s %10s %12s %12s %12s\n", "path", "events", "requests", "total time", "events/sec", "p95 log")
+	for _, run := range []struct{ maxBatch, maxQueued int }{{0, 0}, {100, 1000}, {10, 20}} {
+		om := startStandinOpenMeter()
+		om.setLatency(ingestLatency)
+		client, err := openmeter.NewAuthClientWithResponses(om.URL(), "test-token")
+		if err != nil {
+			log.Fatalf("failed to create client: %v", err)
+		}
+		svc := &ImageGenService{client: client, feature: "gputimecheck", subject: "customer123"}
+		name := "per-event"
+		if run.maxBatch > 0 {
+			svc.batcher = newUsageBatcher(client, run.maxBatch, 50*time.Millisecond, run.maxQueued)
+			name = fmt.Sprintf("batched %d/%d", run.maxBatch, run.maxQueued)
+		}
+
+		var mu sync.Mutex
+		latencies := make([]time.Duration, 0, totalEvents)
+		var wg sync.WaitGroup
+		startTime := time.Now()
+		for i := 0; i < numRoutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < totalEvents/numRoutines; j++ {
+					start := time.Now()
+					_, err := svc.LogUsage(ctx, UsageEvent{
+						Type:   "text2media",
+						Values: map[string]float64{"gpu_time": 30, "outputs": 4},
+					})
+					if err != nil {
+						log.Printf("Error: %v", err)
+					}
+					mu.Lock()
+					latencies = append(latencies, time.Since(start))
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if err := svc.Close(ctx); err != nil {
+			log.Printf("Error flushing usage: %v", err)
+		}
+		totalTime := time.Since(startTime)
+
+		events, _, requests := om.stats()
+		fmt.Printf("%-16s %8d %10d %12v %12.0f %12v\n", name, events, requests,
+			totalTime.Round(time.Millisecond), float64(events)/totalTime.Seconds(), percentile(latencies, 0.95))
+		om.Close()
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2/event"
+	"github.com/google/uuid"
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+)
+
+// usageSource is the default CloudEvent source for our usage.
+const usageSource = "cozy-creator"
+
+// usageValueProperties lists, per event type, the properties our meters
+// aggregate (their valueProperty). OpenMeter only sums numbers, so these have
+// to be in Values; a value property sent as a string is silently not counted.
+var usageValueProperties = map[string][]string{
+	"text2media": {"gpu_time", "outputs"},
+}
+
+// UsageEvent is one request's usage, as LogUsage and the exporter send it.
+type UsageEvent struct {
+	// Source identifies the reporting service. Defaults to usageSource.
+	Source string
+	// ID is the request ID. Events are deduplicated on (Source, ID), by
+	// OpenMeter and by LogUsage. Generated if empty.
+	ID string
+	// Subject is who the usage is billed to (the customer ID).
+	Subject string
+	// Type is the event type meters select on; think endpoint ID.
+	Type string
+	// Time defaults to now.
+	Time time.Time
+	// Values are numeric properties, such as the meters' value properties.
+	Values map[string]float64
+	// Dimensions are string properties for the meters' group-by.
+	Dimensions map[string]string
+}
+
+// withDefaults fills in Source, ID, Time and, from fallbackSubject, Subject.
+func (u UsageEvent) withDefaults(fallbackSubject string) UsageEvent {
+	if u.Source == "" {
+		u.Source = usageSource
+	}
+	if u.ID == "" {
+		u.ID = uuid.NewString()
+	}
+	if u.Time.IsZero() {
+		u.Time = time.Now()
+	}
+	if u.Subject == "" {
+		u.Subject = fallbackSubject
+	}
+	return u
+}
+
+// Validate checks that u can be ingested and will be metered.
+func (u UsageEvent) Validate() error {
+	switch {
+	case u.ID == "":
+		return fmt.Errorf("usage event has no ID")
+	case u.Subject == "":
+		return fmt.Errorf("usage event %s has no subject", u.ID)
+	case u.Type == "":
+		return fmt.Errorf("usage event %s has no type", u.ID)
+	}
+	for name, v := range u.Values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("usage event %s: value %q is %v", u.ID, name, v)
+		}
+		if _, ok := u.Dimensions[name]; ok {
+			return fmt.Errorf("usage event %s: %q is both a value and a dimension", u.ID, name)
+		}
+	}
+	for _, name := range usageValueProperties[u.Type] {
+		if _, ok := u.Values[name]; ok {
+			continue
+		}
+		if _, ok := u.Dimensions[name]; ok {
+			return fmt.Errorf("usage event %s: value property %q must be a number, not a dimension", u.ID, name)
+		}
+		return fmt.Errorf("usage event %s: missing value property %q", u.ID, name)
+	}
+	return nil
+}
+
+// dedupeKey is what the event is deduplicated on.
+func (u UsageEvent) dedupeKey() string {
+	return u.Source + "/" + u.ID
+}
+
+// cloudEvent builds the CloudEvent. Values go into the data as JSON numbers,
+// dimensions as strings.
+func (u UsageEvent) cloudEvent() cloudevents.Event {
+	e := cloudevents.New()
+
+	e.SetTime(u.Time)
+
+	// Events are deduplicated on (source, ID), so the ID must stay the same
+	// however many times this usage is sent.
+	e.SetID(u.ID)
+
+	// Set the event source for an identifier of the reporting service.
+	// Events are deduplicated based on the source and ID.
+	e.SetSource(u.Source)
+
+	// This is better called 'endpointID'. When you create a meter, you can set its 'event type'.
+	// So if you log an event with type 'image-gen' then all meters with that event-type will be
+	// updated.
+	// More abstractly, you could think of this as an 'eventType', and meters operating on
+	// the number of allowed occurences of that event, such as a 'failed generation' meter; you
+	// might sent the event-type as 'failed-genreation', and create a meter which only allows
+	// 5 failed genreations per hour.
+	e.SetType(u.Type)
+
+	// Set the event subject (e.g. the customer ID). Meter values are aggregated by subjects.
+	// This is better called 'customerID'.
+	e.SetSubject(u.Subject)
+
+	// Set the event data, including the valueProperty and groupBy fields.
+	data := make(map[string]any, len(u.Values)+len(u.Dimensions))
+	for name, v := range u.Values {
+		data[name] = v
+	}
+	for name, v := range u.Dimensions {
+		data[name] = v
+	}
+	e.SetData("application/json", data)
+	return e
+}
+
+// usageDeduper remembers (source, id) pairs sent in the last ttl, so a
+// retried request doesn't log its usage twice. OpenMeter deduplicates too,
+// but only after paying for the ingest call. A nil *usageDeduper lets
+// everything through.
+type usageDeduper struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newUsageDeduper(ttl time.Duration) *usageDeduper {
+	return &usageDeduper{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// claim reports whether key is new, and marks it seen if so.
+func (d *usageDeduper) claim(key string) bool {
+	if d == nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if now.Sub(d.lastPrune) > d.ttl {
+		for k, at := range d.seen {
+			if now.Sub(at) > d.ttl {
+				delete(d.seen, k)
+			}
+		}
+		d.lastPrune = now
+	}
+	if at, ok := d.seen[key]; ok && now.Sub(at) <= d.ttl {
+		return false
+	}
+	d.seen[key] = now
+	return true
+}
+
+// release forgets key, for when sending it failed and it should be retried.
+func (d *usageDeduper) release(key string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	delete(d.seen, key)
+	d.mu.Unlock()
+}
+
+// main22 shows the typed event: what Validate rejects, that values arrive as
+// JSON numbers, and that logging one request ID twice sends it once.
+func main22() {
+	ctx := context.Background()
+	om := startStandinOpenMeter()
+	defer om.Close()
+	client, err := openmeter.NewAuthClientWithResponses(om.URL(), "test-token")
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+	svc := &ImageGenService{
+		client:  client,
+		feature: "gputimecheck",
+		subject: "customer123",
+		dedupe:  newUsageDeduper(10 * time.Minute),
+	}
+
+	fmt.Println("=== Validation ===")
+	invalid := []UsageEvent{
+		{Values: map[string]float64{"gpu_time": 30, "outputs": 4}},
+		{Type: "text2media", Values: map[string]float64{"gpu_time": math.NaN(), "outputs": 4}},
+		{Type: "text2media", Values: map[string]float64{"outputs": 4}, Dimensions: map[string]string{"gpu_time": "30"}},
+		{Type: "text2media", Values: map[string]float64{"gpu_time": 30}},
+	}
+	for _, ev := range invalid {
+		_, err := svc.LogUsage(ctx, ev)
+		fmt.Printf("  %v\n", err)
+	}
+
+	fmt.Println("\n=== Deduplication ===")
+	ev := UsageEvent{
+		ID:         "request-1",
+		Type:       "text2media",
+		Values:     map[string]float64{"gpu_time": 30, "outputs": 4},
+		Dimensions: map[string]string{"model": "sdxl"},
+	}
+	for i := 0; i < 3; i++ {
+		sent, err := svc.LogUsage(ctx, ev)
+		fmt.Printf("  attempt %d: sent=%v err=%v\n", i+1, sent, err)
+	}
+	events, duplicates, requests := om.stats()
+	fmt.Printf("  OpenMeter: %d events, %d duplicates, %d requests\n", events, duplicates, requests)
+
+	fmt.Println("\n=== Data as ingested ===")
+	om.mu.Lock()
+	for _, e := range om.events {
+		var data map[string]any
+		if err := json.Unmarshal(e.Data(), &data); err != nil {
+			log.Fatalf("failed to decode event data: %v", err)
+		}
+		for name, v := range data {
+			fmt.Printf("  %-8s %T %v\n", name, v, v)
+		}
+	}
+	om.mu.Unlock()
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2/event"
+	"github.com/google/uuid"
+	openmeter "github.com/openmeterio/openmeter/api/client/go"
+	"github.com/redis/go-redis/v9"
+)
+
+// errPermanentIngest marks ingest failures that retrying won't fix, such as
+// a 400 for a malformed event.
+var errPermanentIngest = errors.New("ingest rejected")
+
+// sendUsageBatch ingests events in one request. 429s, 5xxs and transport
+// errors are returned as they are; other 4xxs wrap errPermanentIngest.
+func sendUsageBatch(ctx context.Context, client *openmeter.ClientWithResponses, events []cloudevents.Event) error {
+	resp, err := client.IngestEventBatchWithResponse(ctx, events)
+	if err != nil {
+		return fmt.Errorf("failed to log usage: %w", err)
+	}
+	code := resp.StatusCode()
+	switch {
+	case code < 400:
+		return nil
+	case code == http.StatusTooManyRequests || code >= 500:
+		return fmt.Errorf("non-2xx status code: %d", code)
+	default:
+		return fmt.Errorf("%w: non-2xx status code: %d", errPermanentIngest, code)
+	}
+}
+
+// usageExporter ships usage to OpenMeter behind the limiter's back. The KV
+// limiter decides admission; each admitted request is handed to Record,
+// which never blocks and never fails, and the exporter gets it to OpenMeter
+// eventually: in batches of batchSize or every flushInterval, retried with
+// backoff, and spooled to disk while OpenMeter is unreachable. The spool is
+// replayed once ingest works again, including after a restart.
+//
+// Event IDs are fixed when the event is recorded and kept through retries
+// and the spool, so anything sent twice is dropped by OpenMeter's
+// (source, id) deduplication rather than billed twice.
+type usageExporter struct {
+	client        *openmeter.ClientWithResponses
+	spoolPath     string
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration
+
+	events chan cloudevents.Event
+	// overflow is what didn't fit in events, for spoolWriter to spool
+	overflow  chan cloudevents.Event
+	spoolMu   sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+	spoolDone chan struct{}
+
+	exported atomic.Int64
+	spooled  atomic.Int64
+	dropped  atomic.Int64
+}
+
+func newUsageExporter(client *openmeter.ClientWithResponses, spoolPath string) *usageExporter {
+	x := &usageExporter{
+		client:        client,
+		spoolPath:     spoolPath,
+		batchSize:     100,
+		flushInterval: time.Second,
+		maxRetries:    3,
+		retryBackoff:  100 * time.Millisecond,
+		events:        make(chan cloudevents.Event, 10000),
+		overflow:      make(chan cloudevents.Event, 10000),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		spoolDone:     make(chan struct{}),
+	}
+	go x.loop()
+	go x.spoolWriter()
+	return x
+}
+
+// Record queues usage for one admitted request. Its ID should be the request
+// ID, the same for every Record of the same request. If the queue is full the
+// event goes to the spool instead, and if the spool is that far behind too
+// it's dropped and counted. Only an invalid event is an error.
+func (x *usageExporter) Record(ev UsageEvent) error {
+	ev = ev.withDefaults("")
+	if err := ev.Validate(); err != nil {
+		return fmt.Errorf("invalid usage event: %w", err)
+	}
+	e := ev.cloudEvent()
+	select {
+	case x.events <- e:
+	default:
+		// Spooling waits on the lock replaySpool holds while it sends, so it
+		// happens on spoolWriter, not here
+		select {
+		case x.overflow <- e:
+		default:
+			x.dropped.Add(1)
+		}
+	}
+	return nil
+}
+
+// spoolWriter spools the events Record couldn't queue, in batches of up to
+// batchSize.
+func (x *usageExporter) spoolWriter() {
+	defer close(x.spoolDone)
+	for {
+		select {
+		case e := <-x.overflow:
+			batch := []cloudevents.Event{e}
+			// Nothing else receives from overflow, so these don't block
+			for len(batch) < x.batchSize && len(x.overflow) > 0 {
+				batch = append(batch, <-x.overflow)
+			}
+			x.spool(batch)
+		case <-x.stop:
+			var batch []cloudevents.Event
+			for {
+				select {
+				case e := <-x.overflow:
+					batch = append(batch, e)
+				default:
+					if len(batch) > 0 {
+						x.spool(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (x *usageExporter) loop() {
+	defer close(x.done)
+	ticker := time.NewTicker(x.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]cloudevents.Event, 0, x.batchSize)
+	for {
+		select {
+		case e := <-x.events:
+			batch = append(batch, e)
+			if len(batch) >= x.batchSize {
+				x.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				x.flush(batch)
+				batch = batch[:0]
+			}
+			x.replaySpool()
+		case <-x.stop:
+			for {
+				select {
+				case e := <-x.events:
+					batch = append(batch, e)
+				default:
+					if len(batch) > 0 {
+						x.flush(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush sends batch, retrying transient failures, and spools it if they
+// persist.
+func (x *usageExporter) flush(batch []cloudevents.Event) {
+	err := x.send(batch)
+	switch {
+	case err == nil:
+		x.exported.Add(int64(len(batch)))
+	case errors.Is(err, errPermanentIngest):
+		x.dropped.Add(int64(len(batch)))
+		log.Printf("Dropping %d usage events: %v", len(batch), err)
+	default:
+		x.spool(batch)
+	}
+}
+
+func (x *usageExporter) send(batch []cloudevents.Event) error {
+	var err error
+	for attempt := 0; attempt <= x.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(x.retryBackoff << (attempt - 1))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = sendUsageBatch(ctx, x.client, batch)
+		cancel()
+		if err == nil || errors.Is(err, errPermanentIngest) {
+			return err
+		}
+	}
+	return err
+}
+
+// spool appends events to the spool file, one JSON event per line.
+func (x *usageExporter) spool(events []cloudevents.Event) {
+	x.spoolMu.Lock()
+	defer x.spoolMu.Unlock()
+	if err := appendSpool(x.spoolPath, events); err != nil {
+		// Nowhere left to put them
+		x.dropped.Add(int64(len(events)))
+		log.Printf("Failed to spool %d usage events: %v", len(events), err)
+		return
+	}
+	x.spooled.Add(int64(len(events)))
+}
+
+func appendSpool(path string, events []cloudevents.Event) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readSpool(path string) ([]cloudevents.Event, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []cloudevents.Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e cloudevents.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A line torn by a crash mid-write; the rest are still good
+			log.Printf("Skipping unreadable spooled event: %v", err)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// replaySpool sends spooled events in batches. Whatever can't be sent yet is
+// written back for the next attempt.
+func (x *usageExporter) replaySpool() {
+	x.spoolMu.Lock()
+	defer x.spoolMu.Unlock()
+
+	events, err := readSpool(x.spoolPath)
+	if err != nil {
+		log.Printf("Failed to read usage spool: %v", err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	sent := 0
+	for sent < len(events) {
+		end := min(sent+x.batchSize, len(events))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := sendUsageBatch(ctx, x.client, events[sent:end])
+		cancel()
+		if errors.Is(err, errPermanentIngest) {
+			x.dropped.Add(int64(end - sent))
+			log.Printf("Dropping %d spooled usage events: %v", end-sent, err)
+		} else if err != nil {
+			// Still down; try again next tick
+			break
+		} else {
+			x.exported.Add(int64(end - sent))
+		}
+		sent = end
+	}
+
+	if sent == 0 {
+		return
+	}
+	rest := events[sent:]
+	tmp := x.spoolPath + ".tmp"
+	os.Remove(tmp)
+	if len(rest) > 0 {
+		if err := appendSpool(tmp, rest); err != nil {
+			log.Printf("Failed to rewrite usage spool: %v", err)
+			return
+		}
+	}
+	if len(rest) == 0 {
+		err = os.Remove(x.spoolPath)
+	} else {
+		err = os.Rename(tmp, x.spoolPath)
+	}
+	if err != nil {
+		log.Printf("Failed to rewrite usage spool: %v", err)
+	}
+}
+
+// Close flushes what is queued. Anything that can't be sent stays in the
+// spool for the next process to replay.
+func (x *usageExporter) Close() {
+	close(x.stop)
+	<-x.done
+	<-x.spoolDone
+}
+
+// main20 puts the exporter behind the Lua window limiter: 10 goroutines make
+// 100 requests each, the limiter admits 800, and every admitted request is
+// recorded. The stand-in ingest endpoint is down for most of the run,
+// so part of the usage goes through the spool. At the end OpenMeter should
+// hold exactly one event per admitted request.
+func main20() {
+	ctx := context.Background()
+	userID := "test_user"
+	endpointID := "test_endpoint"
+
+	server, err := startStandinRedis()
+	if err != nil {
+		log.Fatalf("failed to start stand-in: %v", err)
+	}
+	defer server.Close()
+	rdb := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{server.Addr()}})
+	defer rdb.Close()
+
+	om := startStandinOpenMeter()
+	defer om.Close()
+	client, err := openmeter.NewAuthClientWithResponses(om.URL(), "test-token")
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+
+	spoolDir, err := os.MkdirTemp("", "usage-spool")
+	if err != nil {
+		log.Fatalf("failed to create spool dir: %v", err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	exporter := newUsageExporter(client, filepath.Join(spoolDir, "usage.jsonl"))
+	exporter.batchSize = 50
+	exporter.flushInterval = 50 * time.Millisecond
+	exporter.retryBackoff = 5 * time.Millisecond
+
+	plan := []WindowLimit{{Name: "day", Limit: 800, Period: 24 * time.Hour}}
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < numRoutines; i++ {
+		wg.Add(1)
+		go func(routineID int) {
+			defer wg.Done()
+			for j := 0; j < updatesPerRoutine; j++ {
+				// Ingest is down for most of the run, longer than the
+				// exporter keeps retrying
+				if routineID == 0 && j == 10 {
+					om.down.Store(true)
+				}
+				if routineID == 0 && j == 70 {
+					om.down.Store(false)
+				}
+				decision, _, err := updateLimiterState10(ctx, rdb, userID, endpointID, plan, 1)
+				if err != nil {
+					log.Printf("Error: %v", err)
+					continue
+				}
+				if decision.Allowed {
+					admitted.Add(1)
+					err := exporter.Record(UsageEvent{
+						ID:      uuid.NewString(),
+						Subject: "customer123",
+						Type:    "text2media",
+						Values:  map[string]float64{"gpu_time": 30, "outputs": 4},
+					})
+					if err != nil {
+						log.Printf("Error: %v", err)
+					}
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+	om.down.Store(false)
+
+	// Give the spool a few ticks to drain before shutting down
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if events, _, _ := om.stats(); int64(events) == admitted.Load() {
+			break
+		}
+		time.Sleep(exporter.flushInterval)
+	}
+	exporter.Close()
+
+	events, duplicates, requests := om.stats()
+	fmt.Printf("Admitted: %d\n", admitted.Load())
+	fmt.Printf("Exported: %d, spooled along the way: %d, dropped: %d\n",
+		exporter.exported.Load(), exporter.spooled.Load(), exporter.dropped.Load())
+	fmt.Printf("OpenMeter: %d distinct events, %d duplicates dropped, %d ingest requests\n",
+		events, duplicates, requests)
+}